@@ -2,11 +2,18 @@ package main
 
 import (
 	"context"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/enrichment"
 	"github.com/romanchechyotkin/effective-mobile-test-task/internal/httpserver"
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/jobs"
 	"github.com/romanchechyotkin/effective-mobile-test-task/internal/users"
 	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/names"
 	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/postgresql"
 )
 
@@ -14,6 +21,10 @@ import (
 // @version 1.0
 // @description Effective Mobile test task in Gin Framework
 // @host localhost:8080
+// @securityDefinitions.apikey AdminToken
+// @in header
+// @name Authorization
+// @description Bearer and one of ADMIN_TOKENS, required by admin features
 func main() {
 	log := logger.New(os.Stdout)
 	log.Debug("app running")
@@ -35,7 +46,118 @@ func main() {
 	)
 
 	pgClient := postgresql.NewClient(context.Background(), log, pgConfig)
-	usersDomain := users.RegisterDomain(log, pgClient)
 
-	httpserver.Run(log, usersDomain)
+	enrichmentConfig := enrichment.NewConfig(
+		os.Getenv("AGE_API_URL"),
+		os.Getenv("GENDER_API_URL"),
+		os.Getenv("NATIONALITY_API_URL"),
+		getDurationEnv(log, "ENRICHMENT_TIMEOUT", "5s"),
+	)
+
+	enrichmentClient := enrichment.NewClient(log, enrichmentConfig)
+
+	batchConfig := enrichment.NewBatchConfig(
+		getDurationEnv(log, "ENRICHMENT_BATCH_WINDOW", "20ms"),
+		getIntEnv(log, "ENRICHMENT_BATCH_SIZE", "10"),
+	)
+	dispatcher := enrichment.NewDispatcher(log, enrichmentClient, batchConfig)
+	enricher := enrichment.New(log, dispatcher, dispatcher, dispatcher)
+
+	cacheConfig := enrichment.NewCacheConfig(
+		getDurationEnv(log, "ENRICHMENT_CACHE_TTL", "720h"),
+		getDurationEnv(log, "ENRICHMENT_CACHE_UNKNOWN_TTL", "24h"),
+		getIntEnv(log, "ENRICHMENT_CACHE_SIZE", "1024"),
+	)
+	enrichmentCache := enrichment.NewCache(log, pgClient, enricher, cacheConfig)
+
+	translitScheme, err := names.ParseScheme(os.Getenv("ENRICHMENT_TRANSLIT_SCHEME"))
+	if err != nil {
+		logger.Error(log, "invalid ENRICHMENT_TRANSLIT_SCHEME", err)
+		os.Exit(1)
+	}
+	transliterator := enrichment.NewTransliterator(log, enrichmentCache, translitScheme)
+
+	queueConfig := jobs.NewConfig(
+		getIntEnv(log, "JOBS_WORKERS", "2"),
+		getDurationEnv(log, "JOBS_POLL_INTERVAL", "1s"),
+		getIntEnv(log, "JOBS_MAX_ATTEMPTS", "5"),
+	)
+	queue := jobs.New(log, pgClient, queueConfig)
+
+	idempotencyConfig := users.NewIdempotencyConfig(
+		getDurationEnv(log, "IDEMPOTENCY_KEY_TTL", "24h"),
+	)
+
+	quotaFallback, err := users.ParseQuotaFallback(os.Getenv("ENRICHMENT_QUOTA_FALLBACK"))
+	if err != nil {
+		logger.Error(log, "invalid ENRICHMENT_QUOTA_FALLBACK", err)
+		os.Exit(1)
+	}
+
+	usersDomain := users.RegisterDomain(log, pgClient, transliterator, queue, idempotencyConfig, quotaFallback)
+	enrichmentDomain := enrichment.NewHandler(enrichmentCache, dispatcher, enrichmentClient)
+	jobsDomain := jobs.NewHandler(log, queue)
+
+	schedulerConfig := users.NewSchedulerConfig(
+		getDurationEnv(log, "REENRICH_INTERVAL", "1m"),
+		getDurationEnv(log, "REENRICH_PENDING_AFTER", "5m"),
+		getDurationEnv(log, "REENRICH_STALE_AFTER", "720h"),
+		getDurationEnv(log, "REENRICH_LOW_CONFIDENCE_AFTER", "24h"),
+		float32(getFloatEnv(log, "REENRICH_MIN_GENDER_PROBABILITY", "0.8")),
+	)
+
+	go queue.Run(context.Background())
+	go users.RunScheduler(context.Background(), log, pgClient, queue, schedulerConfig)
+
+	httpserver.Run(log, getListEnv("ADMIN_TOKENS"), usersDomain, enrichmentDomain, jobsDomain)
+}
+
+func getEnv(key, fallback string) string {
+	if val, ok := os.LookupEnv(key); ok && val != "" {
+		return val
+	}
+
+	return fallback
+}
+
+func getDurationEnv(log *slog.Logger, key, fallback string) time.Duration {
+	val, err := time.ParseDuration(getEnv(key, fallback))
+	if err != nil {
+		logger.Error(log, "invalid duration in "+key, err)
+		os.Exit(1)
+	}
+
+	return val
+}
+
+func getIntEnv(log *slog.Logger, key, fallback string) int {
+	val, err := strconv.Atoi(getEnv(key, fallback))
+	if err != nil {
+		logger.Error(log, "invalid integer in "+key, err)
+		os.Exit(1)
+	}
+
+	return val
+}
+
+func getFloatEnv(log *slog.Logger, key, fallback string) float64 {
+	val, err := strconv.ParseFloat(getEnv(key, fallback), 64)
+	if err != nil {
+		logger.Error(log, "invalid number in "+key, err)
+		os.Exit(1)
+	}
+
+	return val
+}
+
+// getListEnv splits a comma separated variable, empty items are skipped.
+func getListEnv(key string) []string {
+	var res []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+
+	return res
 }
@@ -15,6 +15,74 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/enrichment/cache": {
+            "get": {
+                "description": "Hits and misses of the enrichment cache since the process start",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Enrichment cache statistics",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/enrichment.CacheStats"
+                        }
+                    }
+                }
+            }
+        },
+        "/enrichment/dispatcher": {
+            "get": {
+                "description": "Lookups of all providers since the process start, how many of them were coalesced and how many calls were sent",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Enrichment dispatcher statistics",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/enrichment.DispatcherStats"
+                        }
+                    }
+                }
+            }
+        },
+        "/enrichment/quota": {
+            "get": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "Quotas of the providers as of their last responses, admins only.\nProviders with an exhausted quota are not called until reset_at.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Enrichment provider quotas",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/enrichment.Quota"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
         "/health": {
             "get": {
                 "description": "Checking health of backend",
@@ -32,37 +100,418 @@ const docTemplate = `{
                 }
             }
         },
+        "/jobs/{id}": {
+            "get": {
+                "description": "Endpoint for getting status of a background job",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/jobs.Job"
+                        }
+                    }
+                }
+            }
+        },
         "/users": {
             "get": {
-                "description": "Endpoint for getting all users",
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "Endpoint for getting all users, all given filters are combined",
                 "produces": [
                     "application/json"
                 ],
                 "summary": "All users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "male or female",
+                        "name": "gender",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "ISO 3166-1 alpha-2 country codes",
+                        "name": "nationality",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "minimal age, inclusive",
+                        "name": "age_min",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "maximal age, inclusive",
+                        "name": "age_max",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive last name prefix",
+                        "name": "last_name_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive last name substring",
+                        "name": "last_name_contains",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive first name prefix",
+                        "name": "first_name_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive first name substring",
+                        "name": "first_name_contains",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive second name prefix",
+                        "name": "second_name_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive second name substring",
+                        "name": "second_name_contains",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "RFC 3339 timestamp or date, inclusive",
+                        "name": "created_after",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "RFC 3339 timestamp or date, exclusive",
+                        "name": "created_before",
+                        "in": "query"
+                    },
+                    {
+                        "type": "number",
+                        "description": "minimal gender probability, 0..1",
+                        "name": "min_gender_probability",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "minimal agify sample size",
+                        "name": "min_age_count",
+                        "in": "query"
+                    },
+                    {
+                        "type": "number",
+                        "description": "minimal probability of the top nationality, 0..1",
+                        "name": "min_nationality_probability",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "example": "nationality,-age,last_name",
+                        "description": "comma separated columns, minus for descending: id, last_name, first_name, second_name, gender, nationality, age, created_at (default)",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "page size, 20 by default, at most 100",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor or prev_cursor of a previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "count all users matching the filters",
+                        "name": "total",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "list deleted users too, admins only",
+                        "name": "include_deleted",
+                        "in": "query"
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/users.UserResponseDto"
+                            "$ref": "#/definitions/users.UsersPageDto"
+                        },
+                        "headers": {
+                            "Link": {
+                                "type": "string",
+                                "description": "RFC 8288 links to the next and previous pages"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
                             }
                         }
                     }
                 }
             },
             "post": {
-                "description": "Endpoint for creating and saving user to database",
+                "description": "Endpoint for creating and saving user to database.\nIf some enrichment providers fail the user is saved with pending_enrichment status\nand failed_providers listed, the missing fields are filled in later by a background job.\nFields of providers that have no data for the name stay empty and do not make the user pending.\nUsers with the same transliterated full name are listed in possible_duplicates,\nor the request is rejected with 409 when on_duplicate is reject.\nWith Prefer: respond-async the user is enriched and saved by a job after the duplicate check,\nits state is available at the returned location.\nRetries with the same Idempotency-Key get the response of the first request with Idempotent-Replayed: true,\na retry of a request in progress waits for it or gets 409.\nWhile the quota of a provider is exhausted the user is saved as pending_enrichment,\nor the request is rejected with 503 and Retry-After if ENRICHMENT_QUOTA_FALLBACK is reject.\nAsynchronous creates rejected that way end up failed with the quota error.",
                 "produces": [
                     "application/json"
                 ],
                 "summary": "Create user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "warn (default) or reject",
+                        "name": "on_duplicate",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "also match similar and similarly sounding names",
+                        "name": "fuzzy_duplicates",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "respond-async to create the user in the background",
+                        "name": "Prefer",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "unique key of the request, at most 255 characters",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
                 "responses": {
                     "201": {
                         "description": "Created",
                         "schema": {
                             "$ref": "#/definitions/users.UserResponseDto"
                         }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/users.CreateJobDto"
+                        },
+                        "headers": {
+                            "Location": {
+                                "type": "string",
+                                "description": "/users/jobs/{job_id}"
+                            }
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": true
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/users/export": {
+            "get": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "Streams all users matching the filters of the user listing ordered by id, the file is not buffered.\nAn export that fails midway is cut off without the end of the response.",
+                "produces": [
+                    "text/csv",
+                    "application/x-ndjson",
+                    "application/vnd.apache.parquet"
+                ],
+                "summary": "Export users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "csv, ndjson or parquet",
+                        "name": "format",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "male or female",
+                        "name": "gender",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "ISO 3166-1 alpha-2 country codes",
+                        "name": "nationality",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "minimal age, inclusive",
+                        "name": "age_min",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "maximal age, inclusive",
+                        "name": "age_max",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive last name prefix",
+                        "name": "last_name_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive last name substring",
+                        "name": "last_name_contains",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive first name prefix",
+                        "name": "first_name_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive first name substring",
+                        "name": "first_name_contains",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive second name prefix",
+                        "name": "second_name_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "case-insensitive second name substring",
+                        "name": "second_name_contains",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "RFC 3339 timestamp or date, inclusive",
+                        "name": "created_after",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "RFC 3339 timestamp or date, exclusive",
+                        "name": "created_before",
+                        "in": "query"
+                    },
+                    {
+                        "type": "number",
+                        "description": "minimal gender probability, 0..1",
+                        "name": "min_gender_probability",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "minimal agify sample size",
+                        "name": "min_age_count",
+                        "in": "query"
+                    },
+                    {
+                        "type": "number",
+                        "description": "minimal probability of the top nationality, 0..1",
+                        "name": "min_nationality_probability",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "export deleted users too, admins only",
+                        "name": "include_deleted",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "file"
+                        },
+                        "headers": {
+                            "Content-Disposition": {
+                                "type": "string",
+                                "description": "attachment; filename=users.{format}"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
                     }
                 }
             }
@@ -84,17 +533,79 @@ const docTemplate = `{
                 }
             }
         },
-        "/users/{id}": {
+        "/users/import": {
+            "post": {
+                "description": "Endpoint for creating users from a CSV file with last_name, first_name and optional second_name,\nage, gender and nationality columns or from NDJSON with such a user object per line. Given age, gender\nand nationality are kept with import provenance instead of enriched ones. Rows are validated and enriched one by one,\nfailed rows are listed in the report and do not stop the import.\nUploads larger than 1 MiB or sent with Prefer: respond-async are imported by a job,\nits progress and report are available at the returned location.",
+                "consumes": [
+                    "text/csv",
+                    "application/x-ndjson"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Import users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "csv or ndjson, taken from Content-Type by default",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "respond-async to import in the background",
+                        "name": "Prefer",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "who performs the import",
+                        "name": "X-Actor",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/users.ImportReportDto"
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/jobs.Job"
+                        },
+                        "headers": {
+                            "Location": {
+                                "type": "string",
+                                "description": "/jobs/{job_id}"
+                            }
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/users/jobs/{id}": {
             "get": {
-                "description": "Endpoint for getting user with exact id",
+                "description": "Endpoint for polling a user created with Prefer: respond-async.\nThe job goes from queued to enriching to done or failed, the user is included once it is done.",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get exact user",
+                "summary": "Get user creation job",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "id",
+                        "description": "job id",
                         "name": "id",
                         "in": "path",
                         "required": true
@@ -104,41 +615,63 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/users.UserResponseDto"
+                            "$ref": "#/definitions/users.CreateJobDto"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
                         }
                     }
                 }
-            },
-            "delete": {
-                "description": "Endpoint for deleting user with exact id",
+            }
+        },
+        "/users/search": {
+            "get": {
+                "description": "Endpoint for typo tolerant search of users by any part of their full name, best matches first.\nCyrillic and Latin spellings of a name match each other, e.g. \"Aleksandrovich\" finds \"Александрович\".",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Delete exact user",
+                "summary": "Search users",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "id",
-                        "name": "id",
-                        "in": "path",
+                        "description": "part of last, first or second name",
+                        "name": "q",
+                        "in": "query",
                         "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "result count, 20 by default, at most 100",
+                        "name": "limit",
+                        "in": "query"
                     }
                 ],
                 "responses": {
-                    "204": {
-                        "description": "No Content",
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/users.UserResponseDto"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/users.SearchResultDto"
+                            }
                         }
                     }
                 }
-            },
-            "patch": {
-                "description": "Endpoint for updating user with exact id",
+            }
+        },
+        "/users/{id}": {
+            "get": {
+                "description": "Endpoint for getting user with exact id",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Update exact user",
+                "summary": "Get exact user",
                 "parameters": [
                     {
                         "type": "string",
@@ -146,26 +679,810 @@ const docTemplate = `{
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "entity tag of a cached version",
+                        "name": "If-None-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
-                    "204": {
-                        "description": "No Content",
+                    "200": {
+                        "description": "OK",
                         "schema": {
                             "$ref": "#/definitions/users.UserResponseDto"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "version of the user"
+                            }
                         }
+                    },
+                    "304": {
+                        "description": "Not Modified"
                     }
                 }
+            },
+            "delete": {
+                "description": "Endpoint for deleting user with exact id. Deleted users are hidden but can be restored,\npurge removes the user permanently, deleted or not.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Delete exact user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "remove the user permanently",
+                        "name": "purge",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "who performs the deletion",
+                        "name": "X-Actor",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "entity tag the deletion is based on",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content",
+                        "schema": {
+                            "$ref": "#/definitions/users.UserResponseDto"
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "description": "Endpoint for updating user with exact id using JSON Merge Patch (RFC 7396).\nAll changes are applied atomically, explicit null clears second_name, age, gender and nationality.",
+                "consumes": [
+                    "application/merge-patch+json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Update exact user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "who performs the change",
+                        "name": "X-Actor",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "entity tag the change is based on",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "merge patch",
+                        "name": "patch",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/users.UpdateUserDto"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/users.UserResponseDto"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "version of the updated user"
+                            }
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/history": {
+            "get": {
+                "description": "Endpoint for getting all versions of user with exact id, deleted and purged users included.\nEvery create, update, enrichment, deletion, restoration and merge produces a version.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "User history",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/users.HistoryEntryDto"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/history/diff": {
+            "get": {
+                "description": "Endpoint for getting fields that changed between two versions of user with exact id",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Diff of user versions",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "earlier version",
+                        "name": "from",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "later version",
+                        "name": "to",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/users.HistoryDiffDto"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/history/{version}": {
+            "get": {
+                "description": "Endpoint for getting exact version of user with exact id",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "User version",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "version",
+                        "name": "version",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/users.HistoryEntryDto"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/merge": {
+            "post": {
+                "description": "Endpoint for merging the source user into the user with exact id, the source user is deleted.\nEvery field is resolved with its strategy from fields or with strategy, prefer_manual by default:\nkeep_target keeps the value of the target, keep_source takes the value of the source,\nprefer_manual takes manually set values over enriched ones and fills in empty fields of the target.\nValues taken from the source keep their provenance.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Merge users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id of the surviving user",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "who performs the merge",
+                        "name": "X-Actor",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "entity tag the merge is based on",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "source user and resolution strategies",
+                        "name": "merge",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/users.MergeUsersDto"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/users.UserResponseDto"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "version of the merged user"
+                            }
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/re-enrich": {
+            "post": {
+                "description": "Endpoint for scheduling fresh enrichment of user with exact id, bypassing the enrichment cache",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Re-enrich user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/jobs.Job"
+                        },
+                        "headers": {
+                            "Location": {
+                                "type": "string",
+                                "description": "/jobs/{job_id}"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/restore": {
+            "post": {
+                "description": "Endpoint for restoring deleted user with exact id",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Restore exact user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "who performs the restoration",
+                        "name": "X-Actor",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "entity tag the restoration is based on",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/users.UserResponseDto"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "version of the restored user"
+                            }
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/revert": {
+            "post": {
+                "description": "Endpoint for restoring all fields of user with exact id to a version from its history.\nThe past is not rewritten, the revert is a new version. Deleted users have to be restored first.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Revert user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "version to revert to",
+                        "name": "version",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "who performs the revert",
+                        "name": "X-Actor",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "entity tag the revert is based on",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/users.UserResponseDto"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "version of the reverted user"
+                            }
+                        }
+                    },
+                    "412": {
+                        "description": "Precondition Failed",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "enrichment.CacheStats": {
+            "type": "object",
+            "properties": {
+                "database_hits": {
+                    "type": "integer"
+                },
+                "memory_hits": {
+                    "type": "integer"
+                },
+                "misses": {
+                    "type": "integer"
+                },
+                "size": {
+                    "type": "integer"
+                }
             }
-        }
-    },
-    "definitions": {
+        },
+        "enrichment.DispatcherStats": {
+            "type": "object",
+            "properties": {
+                "calls": {
+                    "description": "Calls is the number of requests sent to the providers.",
+                    "type": "integer"
+                },
+                "coalesced": {
+                    "type": "integer"
+                },
+                "lookups": {
+                    "description": "Lookups is the number of names asked for, Coalesced of them joined a lookup of the same name in progress.",
+                    "type": "integer"
+                }
+            }
+        },
+        "enrichment.Quota": {
+            "type": "object",
+            "properties": {
+                "exhausted": {
+                    "type": "boolean"
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "provider": {
+                    "type": "string"
+                },
+                "remaining": {
+                    "type": "integer"
+                },
+                "reset_at": {
+                    "type": "string"
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "jobs.Job": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "key": {
+                    "type": "string"
+                },
+                "kind": {
+                    "type": "string"
+                },
+                "payload": {
+                    "type": "object"
+                },
+                "progress": {
+                    "type": "object"
+                },
+                "result": {
+                    "type": "object"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "users.CreateJobDto": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "queued",
+                        "enriching",
+                        "done",
+                        "failed"
+                    ]
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "user": {
+                    "$ref": "#/definitions/users.UserResponseDto"
+                }
+            }
+        },
+        "users.EnrichmentDto": {
+            "type": "object",
+            "properties": {
+                "age_count": {
+                    "type": "integer"
+                },
+                "gender_probability": {
+                    "type": "number"
+                },
+                "lookup_key": {
+                    "type": "string"
+                },
+                "nationalities": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/users.NationalityDto"
+                    }
+                }
+            }
+        },
+        "users.FieldChangeDto": {
+            "type": "object",
+            "properties": {
+                "from": {},
+                "to": {}
+            }
+        },
+        "users.HistoryDiffDto": {
+            "type": "object",
+            "properties": {
+                "changes": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/users.FieldChangeDto"
+                    }
+                },
+                "from": {
+                    "type": "integer"
+                },
+                "to": {
+                    "type": "integer"
+                }
+            }
+        },
+        "users.HistoryEntryDto": {
+            "type": "object",
+            "properties": {
+                "actor": {
+                    "type": "string"
+                },
+                "changed_at": {
+                    "type": "string"
+                },
+                "operation": {
+                    "type": "string"
+                },
+                "request_id": {
+                    "type": "string"
+                },
+                "snapshot": {
+                    "$ref": "#/definitions/users.UserSnapshotDto"
+                },
+                "version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "users.ImportReportDto": {
+            "type": "object",
+            "properties": {
+                "created": {
+                    "type": "integer"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "failed": {
+                    "type": "integer"
+                },
+                "rows": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/users.ImportRowDto"
+                    }
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "users.ImportRowDto": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "row": {
+                    "type": "integer"
+                },
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "users.MergeUsersDto": {
+            "type": "object",
+            "properties": {
+                "fields": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "source_id": {
+                    "type": "string"
+                },
+                "strategy": {
+                    "type": "string",
+                    "enum": [
+                        "keep_target",
+                        "keep_source",
+                        "prefer_manual"
+                    ]
+                }
+            }
+        },
+        "users.NationalityDto": {
+            "type": "object",
+            "properties": {
+                "country_id": {
+                    "type": "string"
+                },
+                "probability": {
+                    "type": "number"
+                }
+            }
+        },
+        "users.ProvenanceDto": {
+            "type": "object",
+            "properties": {
+                "actor": {
+                    "type": "string"
+                },
+                "source": {
+                    "type": "string"
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "users.SearchResultDto": {
+            "type": "object",
+            "properties": {
+                "score": {
+                    "type": "number"
+                },
+                "user": {
+                    "$ref": "#/definitions/users.UserResponseDto"
+                }
+            }
+        },
+        "users.UpdateUserDto": {
+            "type": "object",
+            "properties": {
+                "age": {
+                    "type": "integer"
+                },
+                "first_name": {
+                    "type": "string"
+                },
+                "gender": {
+                    "type": "string"
+                },
+                "last_name": {
+                    "type": "string"
+                },
+                "nationality": {
+                    "type": "string"
+                },
+                "second_name": {
+                    "type": "string"
+                }
+            }
+        },
         "users.UserResponseDto": {
             "type": "object",
             "properties": {
                 "age": {
                     "type": "integer"
                 },
+                "created_at": {
+                    "type": "string"
+                },
+                "deleted_at": {
+                    "type": "string"
+                },
+                "enrichment": {
+                    "description": "Enrichment and Provenance are only filled in for single user responses.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/users.EnrichmentDto"
+                        }
+                    ]
+                },
+                "failed_providers": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
                 "first_name": {
                     "type": "string"
                 },
@@ -181,11 +1498,93 @@ const docTemplate = `{
                 "nationality": {
                     "type": "string"
                 },
+                "possible_duplicates": {
+                    "description": "PossibleDuplicates are ids of users with the same name, only filled in on create.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "provenance": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/users.ProvenanceDto"
+                    }
+                },
+                "second_name": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "users.UserSnapshotDto": {
+            "type": "object",
+            "properties": {
+                "age": {
+                    "type": "integer"
+                },
+                "deleted_at": {
+                    "type": "string"
+                },
+                "first_name": {
+                    "type": "string"
+                },
+                "gender": {
+                    "type": "string"
+                },
+                "last_name": {
+                    "type": "string"
+                },
+                "nationality": {
+                    "type": "string"
+                },
+                "provenance": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/users.ProvenanceDto"
+                    }
+                },
                 "second_name": {
                     "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "users.UsersPageDto": {
+            "type": "object",
+            "properties": {
+                "data": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/users.UserResponseDto"
+                    }
+                },
+                "next_cursor": {
+                    "type": "string"
+                },
+                "prev_cursor": {
+                    "type": "string"
+                },
+                "total": {
+                    "type": "integer"
                 }
             }
         }
+    },
+    "securityDefinitions": {
+        "AdminToken": {
+            "description": "Bearer and one of ADMIN_TOKENS, required by admin features",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
+        }
     }
 }`
 
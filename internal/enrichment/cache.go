@@ -0,0 +1,172 @@
+package enrichment
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+)
+
+const (
+	DefaultCacheTTL = 30 * 24 * time.Hour
+	// DefaultUnknownCacheTTL is shorter, providers may learn about a name they had no data for.
+	DefaultUnknownCacheTTL = 24 * time.Hour
+	DefaultCacheSize       = 1024
+)
+
+type CacheStats struct {
+	MemoryHits   uint64 `json:"memory_hits"`
+	DatabaseHits uint64 `json:"database_hits"`
+	Misses       uint64 `json:"misses"`
+	Size         int    `json:"size"`
+}
+
+// Cache is an Enricher that remembers results of the wrapped one.
+type Cache interface {
+	Enricher
+	Stats() CacheStats
+}
+
+type cacheConfig struct {
+	ttl        time.Duration
+	unknownTTL time.Duration
+	size       int
+}
+
+// NewCacheConfig configures the cache, results with names unknown to a provider are kept for unknownTTL.
+func NewCacheConfig(ttl, unknownTTL time.Duration, size int) *cacheConfig {
+	cfg := &cacheConfig{
+		ttl:        ttl,
+		unknownTTL: unknownTTL,
+		size:       size,
+	}
+
+	if cfg.ttl <= 0 {
+		cfg.ttl = DefaultCacheTTL
+	}
+	if cfg.unknownTTL <= 0 {
+		cfg.unknownTTL = DefaultUnknownCacheTTL
+	}
+	if cfg.size < 0 {
+		cfg.size = DefaultCacheSize
+	}
+
+	return cfg
+}
+
+type noCacheKey struct{}
+
+// WithoutCache makes the cache skip lookups for ctx, fresh results are still stored.
+func WithoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+// cache looks a name up in the in-process LRU, then in the enrichment_cache table,
+// and only then asks the wrapped enricher. Callers get copies of the cached results.
+type cache struct {
+	log        *slog.Logger
+	next       Enricher
+	repository cacheStorage
+	memory     *lru
+	ttl        time.Duration
+	unknownTTL time.Duration
+
+	memoryHits   atomic.Uint64
+	databaseHits atomic.Uint64
+	misses       atomic.Uint64
+}
+
+func NewCache(logger *slog.Logger, pool *pgxpool.Pool, next Enricher, cfg *cacheConfig) Cache {
+	return &cache{
+		log:        logger,
+		next:       next,
+		repository: newRepository(logger, pool),
+		memory:     newLRU(cfg.size),
+		ttl:        cfg.ttl,
+		unknownTTL: cfg.unknownTTL,
+	}
+}
+
+func (c *cache) Enrich(ctx context.Context, name string) (*Result, error) {
+	key := normalizeName(name)
+
+	if skip, _ := ctx.Value(noCacheKey{}).(bool); skip {
+		c.log.Debug("enrichment cache skipped", slog.String("name", key))
+		return c.fetch(ctx, name, key)
+	}
+
+	if entry, ok := c.memory.get(key); ok {
+		if c.fresh(entry.result, entry.fetchedAt) {
+			c.memoryHits.Add(1)
+			c.log.Debug("enrichment cache hit", slog.String("name", key), slog.String("layer", "memory"))
+			res := entry.result.clone()
+			return res, res.unknownErr()
+		}
+		c.memory.remove(key)
+	}
+
+	res, fetchedAt, err := c.repository.getCached(ctx, key)
+	switch {
+	case err == nil && c.fresh(res, fetchedAt):
+		c.databaseHits.Add(1)
+		c.log.Debug("enrichment cache hit", slog.String("name", key), slog.String("layer", "database"))
+		c.memory.add(key, res.clone(), fetchedAt)
+		return res, res.unknownErr()
+	case err != nil && !errors.Is(err, errCacheMiss):
+		logger.Error(c.log, "error during reading enrichment cache", err)
+	}
+
+	c.misses.Add(1)
+	c.log.Debug("enrichment cache miss", slog.String("name", key))
+
+	return c.fetch(ctx, name, key)
+}
+
+// fetch asks the wrapped enricher and stores complete results in both layers,
+// including the ones with names unknown to some providers. Results of some of the providers are not stored.
+func (c *cache) fetch(ctx context.Context, name, key string) (*Result, error) {
+	res, err := c.next.Enrich(ctx, name)
+	if res == nil || !res.Complete() {
+		return res, err
+	}
+	if _, partial := ctx.Value(providersKey{}).([]string); partial {
+		return res, err
+	}
+
+	fetchedAt, saveErr := c.repository.saveCached(ctx, key, res)
+	if saveErr != nil {
+		logger.Error(c.log, "error during writing enrichment cache", saveErr)
+		fetchedAt = time.Now()
+	}
+	c.memory.add(key, res.clone(), fetchedAt)
+
+	return res, err
+}
+
+func (c *cache) Stats() CacheStats {
+	return CacheStats{
+		MemoryHits:   c.memoryHits.Load(),
+		DatabaseHits: c.databaseHits.Load(),
+		Misses:       c.misses.Load(),
+		Size:         c.memory.len(),
+	}
+}
+
+func (c *cache) fresh(res *Result, fetchedAt time.Time) bool {
+	ttl := c.ttl
+	if len(res.Unknown) != 0 {
+		ttl = min(ttl, c.unknownTTL)
+	}
+
+	return time.Since(fetchedAt) < ttl
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
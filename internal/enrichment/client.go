@@ -0,0 +1,224 @@
+package enrichment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultAgeApi         = "https://api.agify.io/"
+	DefaultGenderApi      = "https://api.genderize.io/"
+	DefaultNationalityApi = "https://api.nationalize.io/"
+	DefaultTimeout        = 5 * time.Second
+)
+
+type config struct {
+	ageApi         string
+	genderApi      string
+	nationalityApi string
+	timeout        time.Duration
+}
+
+// NewConfig builds client config, empty values fall back to the public agify/genderize/nationalize APIs.
+func NewConfig(ageApi, genderApi, nationalityApi string, timeout time.Duration) *config {
+	cfg := &config{
+		ageApi:         ageApi,
+		genderApi:      genderApi,
+		nationalityApi: nationalityApi,
+		timeout:        timeout,
+	}
+
+	if cfg.ageApi == "" {
+		cfg.ageApi = DefaultAgeApi
+	}
+	if cfg.genderApi == "" {
+		cfg.genderApi = DefaultGenderApi
+	}
+	if cfg.nationalityApi == "" {
+		cfg.nationalityApi = DefaultNationalityApi
+	}
+	if cfg.timeout <= 0 {
+		cfg.timeout = DefaultTimeout
+	}
+
+	return cfg
+}
+
+// Provider is implemented by clients that can answer all enrichment queries.
+type Provider interface {
+	AgeProvider
+	GenderProvider
+	NationalityProvider
+}
+
+// BatchProvider looks up to MaxBatchSize names up in a single call per provider,
+// results are in the order of the names. Unknown names are not reported as errors.
+type BatchProvider interface {
+	Ages(ctx context.Context, names []string) ([]*AgeRequestDto, error)
+	Genders(ctx context.Context, names []string) ([]*GenderRequestDto, error)
+	Nationalities(ctx context.Context, names []string) ([]*NationalityRequestDto, error)
+}
+
+// Client answers both single and batched enrichment queries and keeps track of the provider quotas.
+type Client interface {
+	Provider
+	BatchProvider
+	QuotaTracker
+}
+
+// client talks to agify.io, genderize.io and nationalize.io.
+type client struct {
+	log    *slog.Logger
+	http   *http.Client
+	cfg    *config
+	quotas *quotaTracker
+}
+
+func NewClient(logger *slog.Logger, cfg *config) Client {
+	return &client{
+		log: logger,
+		http: &http.Client{
+			Timeout: cfg.timeout,
+		},
+		cfg:    cfg,
+		quotas: newQuotaTracker(ProviderAge, ProviderGender, ProviderNationality),
+	}
+}
+
+func (c *client) Age(ctx context.Context, name string) (*AgeRequestDto, error) {
+	var dto AgeRequestDto
+	err := c.get(ctx, ProviderAge, c.cfg.ageApi, url.Values{"name": {name}}, &dto)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAge(&dto)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto, nil
+}
+
+func (c *client) Gender(ctx context.Context, name string) (*GenderRequestDto, error) {
+	var dto GenderRequestDto
+	err := c.get(ctx, ProviderGender, c.cfg.genderApi, url.Values{"name": {name}}, &dto)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkGender(&dto)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto, nil
+}
+
+func (c *client) Nationality(ctx context.Context, name string) (*NationalityRequestDto, error) {
+	var dto NationalityRequestDto
+	err := c.get(ctx, ProviderNationality, c.cfg.nationalityApi, url.Values{"name": {name}}, &dto)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkNationality(&dto)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto, nil
+}
+
+func (c *client) Ages(ctx context.Context, names []string) ([]*AgeRequestDto, error) {
+	var dtos []*AgeRequestDto
+	err := c.get(ctx, ProviderAge, c.cfg.ageApi, url.Values{"name[]": names}, &dtos)
+	return dtos, err
+}
+
+func (c *client) Genders(ctx context.Context, names []string) ([]*GenderRequestDto, error) {
+	var dtos []*GenderRequestDto
+	err := c.get(ctx, ProviderGender, c.cfg.genderApi, url.Values{"name[]": names}, &dtos)
+	return dtos, err
+}
+
+func (c *client) Nationalities(ctx context.Context, names []string) ([]*NationalityRequestDto, error) {
+	var dtos []*NationalityRequestDto
+	err := c.get(ctx, ProviderNationality, c.cfg.nationalityApi, url.Values{"name[]": names}, &dtos)
+	return dtos, err
+}
+
+func (c *client) Quotas() []Quota {
+	return c.quotas.Quotas()
+}
+
+func checkAge(dto *AgeRequestDto) error {
+	if dto.Count == 0 {
+		return fmt.Errorf("%s: %w", ProviderAge, ErrUnknownName)
+	}
+
+	return nil
+}
+
+func checkGender(dto *GenderRequestDto) error {
+	if dto.Gender == "" {
+		return fmt.Errorf("%s: %w", ProviderGender, ErrUnknownName)
+	}
+
+	return nil
+}
+
+func checkNationality(dto *NationalityRequestDto) error {
+	if len(dto.Country) == 0 {
+		return fmt.Errorf("%s: %w", ProviderNationality, ErrUnknownName)
+	}
+
+	return nil
+}
+
+// get asks the provider unless its quota is exhausted, the quota is updated from the response.
+func (c *client) get(ctx context.Context, provider, api string, params url.Values, dst any) error {
+	err := c.quotas.check(provider)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(api)
+	if err != nil {
+		return err
+	}
+
+	q := u.Query()
+	for key, values := range params {
+		q[key] = values
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	c.log.Debug("enrichment request", slog.String("url", u.String()))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	c.quotas.update(provider, resp)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return c.quotas.check(provider)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with status %d", u.Host, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
@@ -0,0 +1,222 @@
+package enrichment
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+)
+
+const (
+	// MaxBatchSize is the most names the providers accept in a single call.
+	MaxBatchSize       = 10
+	DefaultBatchWindow = 20 * time.Millisecond
+)
+
+type DispatcherStats struct {
+	// Lookups is the number of names asked for, Coalesced of them joined a lookup of the same name in progress.
+	Lookups   uint64 `json:"lookups"`
+	Coalesced uint64 `json:"coalesced"`
+	// Calls is the number of requests sent to the providers.
+	Calls uint64 `json:"calls"`
+}
+
+// Dispatcher is a Provider that coalesces concurrent lookups of the same name
+// and batches lookups of different names into calls of up to MaxBatchSize names.
+type Dispatcher interface {
+	Provider
+	Stats() DispatcherStats
+}
+
+type batchConfig struct {
+	window time.Duration
+	size   int
+}
+
+// NewBatchConfig configures batching, a batch is sent once it has size names or window has passed since its first name.
+func NewBatchConfig(window time.Duration, size int) *batchConfig {
+	cfg := &batchConfig{
+		window: window,
+		size:   size,
+	}
+
+	if cfg.window <= 0 {
+		cfg.window = DefaultBatchWindow
+	}
+	if cfg.size <= 0 || cfg.size > MaxBatchSize {
+		cfg.size = MaxBatchSize
+	}
+
+	return cfg
+}
+
+type dispatcher struct {
+	age         *batcher[AgeRequestDto]
+	gender      *batcher[GenderRequestDto]
+	nationality *batcher[NationalityRequestDto]
+}
+
+func NewDispatcher(logger *slog.Logger, provider BatchProvider, cfg *batchConfig) Dispatcher {
+	return &dispatcher{
+		age:         newBatcher(logger, ProviderAge, cfg, provider.Ages, checkAge),
+		gender:      newBatcher(logger, ProviderGender, cfg, provider.Genders, checkGender),
+		nationality: newBatcher(logger, ProviderNationality, cfg, provider.Nationalities, checkNationality),
+	}
+}
+
+func (d *dispatcher) Age(ctx context.Context, name string) (*AgeRequestDto, error) {
+	return d.age.lookup(ctx, name)
+}
+
+func (d *dispatcher) Gender(ctx context.Context, name string) (*GenderRequestDto, error) {
+	return d.gender.lookup(ctx, name)
+}
+
+func (d *dispatcher) Nationality(ctx context.Context, name string) (*NationalityRequestDto, error) {
+	return d.nationality.lookup(ctx, name)
+}
+
+func (d *dispatcher) Stats() DispatcherStats {
+	var stats DispatcherStats
+	for _, b := range []*batcherStats{&d.age.stats, &d.gender.stats, &d.nationality.stats} {
+		stats.Lookups += b.lookups.Load()
+		stats.Coalesced += b.coalesced.Load()
+		stats.Calls += b.calls.Load()
+	}
+
+	return stats
+}
+
+type batcherStats struct {
+	lookups   atomic.Uint64
+	coalesced atomic.Uint64
+	calls     atomic.Uint64
+}
+
+// call is a lookup of a name shared by everyone asking for it, done is closed once res and err are set.
+type call[T any] struct {
+	done chan struct{}
+	res  *T
+	err  error
+}
+
+type batch[T any] struct {
+	names []string
+	calls []*call[T]
+}
+
+// batcher collects lookups of a single provider into batches.
+type batcher[T any] struct {
+	log      *slog.Logger
+	provider string
+	cfg      *batchConfig
+	fetch    func(ctx context.Context, names []string) ([]*T, error)
+	// check reports names the provider knows nothing about.
+	check func(*T) error
+	stats batcherStats
+
+	mu      sync.Mutex
+	pending *batch[T]
+	calls   map[string]*call[T]
+}
+
+func newBatcher[T any](logger *slog.Logger, provider string, cfg *batchConfig, fetch func(context.Context, []string) ([]*T, error), check func(*T) error) *batcher[T] {
+	return &batcher[T]{
+		log:      logger,
+		provider: provider,
+		cfg:      cfg,
+		fetch:    fetch,
+		check:    check,
+		calls:    make(map[string]*call[T]),
+	}
+}
+
+// lookup adds the name to the pending batch unless it is already looked up, and waits for the result.
+func (b *batcher[T]) lookup(ctx context.Context, name string) (*T, error) {
+	b.stats.lookups.Add(1)
+
+	b.mu.Lock()
+	c, ok := b.calls[name]
+	if ok {
+		b.stats.coalesced.Add(1)
+	} else {
+		c = &call[T]{done: make(chan struct{})}
+		b.calls[name] = c
+		b.enqueue(name, c)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.res, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// enqueue adds a call to the pending batch, a full batch is sent right away. b.mu has to be held.
+func (b *batcher[T]) enqueue(name string, c *call[T]) {
+	if b.pending == nil {
+		pending := &batch[T]{}
+		b.pending = pending
+		time.AfterFunc(b.cfg.window, func() {
+			b.mu.Lock()
+			if b.pending != pending {
+				// sent already because it was full
+				b.mu.Unlock()
+				return
+			}
+			b.pending = nil
+			b.mu.Unlock()
+
+			b.send(pending)
+		})
+	}
+
+	b.pending.names = append(b.pending.names, name)
+	b.pending.calls = append(b.pending.calls, c)
+
+	if len(b.pending.names) >= b.cfg.size {
+		full := b.pending
+		b.pending = nil
+		go b.send(full)
+	}
+}
+
+// send looks the batch up and hands the results out. The batch serves several requests,
+// so it does not depend on their contexts, the client timeout limits it.
+func (b *batcher[T]) send(pending *batch[T]) {
+	b.stats.calls.Add(1)
+	b.log.Debug("enrichment batch", slog.String("provider", b.provider), slog.Int("names", len(pending.names)))
+
+	results, err := b.fetch(context.Background(), pending.names)
+	if err == nil && len(results) != len(pending.names) {
+		err = fmt.Errorf("%s returned %d results for %d names", b.provider, len(results), len(pending.names))
+	}
+	if err != nil {
+		logger.Error(b.log, "error during enrichment batch", err)
+	}
+
+	b.mu.Lock()
+	for i, c := range pending.calls {
+		switch {
+		case err != nil:
+			c.err = err
+		case results[i] == nil:
+			c.err = fmt.Errorf("%s: %w", b.provider, ErrUnknownName)
+		default:
+			c.err = b.check(results[i])
+			if c.err == nil {
+				c.res = results[i]
+			}
+		}
+
+		delete(b.calls, pending.names[i])
+		close(c.done)
+	}
+	b.mu.Unlock()
+}
@@ -0,0 +1,91 @@
+package enrichment
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type AgeRequestDto struct {
+	Count int    `json:"count"`
+	Name  string `json:"name"`
+	Age   int    `json:"age"`
+}
+
+type GenderRequestDto struct {
+	Count       int     `json:"count"`
+	Name        string  `json:"name"`
+	Gender      string  `json:"gender"`
+	Probability float32 `json:"probability"`
+}
+
+type NationalityRequestDto struct {
+	Count   int       `json:"count"`
+	Name    string    `json:"name"`
+	Country []Country `json:"country"`
+}
+
+type Country struct {
+	CountryID   string  `json:"country_id"`
+	Probability float32 `json:"probability"`
+}
+
+// Result aggregates the answers of all providers for a single name.
+// Fields of failed providers are nil and their names are listed in Failed, providers
+// that have no data for the name are listed in Unknown instead, asking them again does not help.
+// Key is the name that was actually sent to the providers.
+type Result struct {
+	Key         string
+	Age         *AgeRequestDto
+	Gender      *GenderRequestDto
+	Nationality *NationalityRequestDto
+	Failed      []string
+	Unknown     []string
+}
+
+// Complete reports whether no provider failed, names unknown to a provider are final.
+func (r *Result) Complete() bool {
+	return len(r.Failed) == 0
+}
+
+// clone copies the result deeply, so that the copy can be changed and kept independently.
+func (r *Result) clone() *Result {
+	res := *r
+	if r.Age != nil {
+		age := *r.Age
+		res.Age = &age
+	}
+	if r.Gender != nil {
+		gender := *r.Gender
+		res.Gender = &gender
+	}
+	if r.Nationality != nil {
+		nationality := *r.Nationality
+		nationality.Country = slices.Clone(r.Nationality.Country)
+		res.Nationality = &nationality
+	}
+	res.Failed = slices.Clone(r.Failed)
+	res.Unknown = slices.Clone(r.Unknown)
+
+	return &res
+}
+
+// unknownErr is the error Enrich returns for the providers listed in Unknown, nil if there are none.
+func (r *Result) unknownErr() error {
+	errs := make([]error, len(r.Unknown))
+	for i, provider := range r.Unknown {
+		errs[i] = fmt.Errorf("%s: %w", provider, ErrUnknownName)
+	}
+
+	return errors.Join(errs...)
+}
+
+// fail lists the provider in Failed, or in Unknown if it has no data for the name.
+func (r *Result) fail(provider string, err error) {
+	if errors.Is(err, ErrUnknownName) {
+		r.Unknown = append(r.Unknown, provider)
+		return
+	}
+
+	r.Failed = append(r.Failed, provider)
+}
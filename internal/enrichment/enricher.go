@@ -0,0 +1,131 @@
+package enrichment
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+)
+
+const (
+	ProviderAge         = "agify"
+	ProviderGender      = "genderize"
+	ProviderNationality = "nationalize"
+)
+
+// ErrUnknownName is returned by providers that have no data for the requested name.
+var ErrUnknownName = errors.New("provider has no data for the name")
+
+type AgeProvider interface {
+	Age(ctx context.Context, name string) (*AgeRequestDto, error)
+}
+
+type GenderProvider interface {
+	Gender(ctx context.Context, name string) (*GenderRequestDto, error)
+}
+
+type NationalityProvider interface {
+	Nationality(ctx context.Context, name string) (*NationalityRequestDto, error)
+}
+
+// Enricher resolves demographic data for a first name.
+type Enricher interface {
+	Enrich(ctx context.Context, name string) (*Result, error)
+}
+
+type providersKey struct{}
+
+// WithProviders makes Enrich ask only the given providers for ctx. The fields of the others
+// are left nil, they are neither failed nor unknown. Such partial results are not cached.
+func WithProviders(ctx context.Context, providers ...string) context.Context {
+	return context.WithValue(ctx, providersKey{}, providers)
+}
+
+// asked reports whether the provider is to be asked for ctx.
+func asked(ctx context.Context, provider string) bool {
+	providers, ok := ctx.Value(providersKey{}).([]string)
+	return !ok || slices.Contains(providers, provider)
+}
+
+type enricher struct {
+	log         *slog.Logger
+	age         AgeProvider
+	gender      GenderProvider
+	nationality NationalityProvider
+}
+
+func New(logger *slog.Logger, age AgeProvider, gender GenderProvider, nationality NationalityProvider) Enricher {
+	return &enricher{
+		log:         logger,
+		age:         age,
+		gender:      gender,
+		nationality: nationality,
+	}
+}
+
+// Enrich queries all providers concurrently, or the ones chosen with WithProviders. The result
+// is returned even if some providers failed, alongside the joined error of the failed ones.
+func (e *enricher) Enrich(ctx context.Context, name string) (*Result, error) {
+	var res Result
+	var wg sync.WaitGroup
+	var ageErr, genderErr, nationalityErr error
+
+	if asked(ctx, ProviderAge) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.Age, ageErr = e.age.Age(ctx, name)
+			if ageErr != nil {
+				logger.Error(e.log, "error during request to age provider", ageErr)
+				return
+			}
+			e.log.Debug("got age", slog.Any("dto", res.Age))
+		}()
+	}
+
+	if asked(ctx, ProviderGender) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.Gender, genderErr = e.gender.Gender(ctx, name)
+			if genderErr != nil {
+				logger.Error(e.log, "error during request to gender provider", genderErr)
+				return
+			}
+			e.log.Debug("got gender", slog.Any("dto", res.Gender))
+		}()
+	}
+
+	if asked(ctx, ProviderNationality) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.Nationality, nationalityErr = e.nationality.Nationality(ctx, name)
+			if nationalityErr != nil {
+				logger.Error(e.log, "error during request to nationality provider", nationalityErr)
+				return
+			}
+			e.log.Debug("got nationality", slog.Any("dto", res.Nationality))
+		}()
+	}
+
+	wg.Wait()
+
+	if ageErr != nil {
+		res.Age = nil
+		res.fail(ProviderAge, ageErr)
+	}
+	if genderErr != nil {
+		res.Gender = nil
+		res.fail(ProviderGender, genderErr)
+	}
+	if nationalityErr != nil {
+		res.Nationality = nil
+		res.fail(ProviderNationality, nationalityErr)
+	}
+
+	return &res, errors.Join(ageErr, genderErr, nationalityErr)
+}
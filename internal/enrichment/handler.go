@@ -0,0 +1,70 @@
+package enrichment
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/httpserver"
+)
+
+type handler struct {
+	cache      Cache
+	dispatcher Dispatcher
+	quotas     QuotaTracker
+}
+
+func NewHandler(cache Cache, dispatcher Dispatcher, quotas QuotaTracker) httpserver.Handler {
+	h := &handler{
+		cache:      cache,
+		dispatcher: dispatcher,
+		quotas:     quotas,
+	}
+
+	return h
+}
+
+func (h *handler) RegisterRoutes(engine *gin.Engine) {
+	group := engine.Group("/enrichment")
+
+	group.GET("/cache", h.cacheStats)
+	group.GET("/dispatcher", h.dispatcherStats)
+	group.GET("/quota", h.quota)
+}
+
+// @Summary Enrichment cache statistics
+// @Description Hits and misses of the enrichment cache since the process start
+// @Produce application/json
+// @Success 200 {object} CacheStats
+// @Router /enrichment/cache [get]
+func (h *handler) cacheStats(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, h.cache.Stats())
+}
+
+// @Summary Enrichment dispatcher statistics
+// @Description Lookups of all providers since the process start, how many of them were coalesced and how many calls were sent
+// @Produce application/json
+// @Success 200 {object} DispatcherStats
+// @Router /enrichment/dispatcher [get]
+func (h *handler) dispatcherStats(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, h.dispatcher.Stats())
+}
+
+// @Summary Enrichment provider quotas
+// @Description Quotas of the providers as of their last responses, admins only.
+// @Description Providers with an exhausted quota are not called until reset_at.
+// @Produce application/json
+// @Security AdminToken
+// @Success 200 {object} []Quota
+// @Failure 403 {object} map[string]string
+// @Router /enrichment/quota [get]
+func (h *handler) quota(ctx *gin.Context) {
+	if !httpserver.IsAdmin(ctx) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error": "only admins can see provider quotas",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, h.quotas.Quotas())
+}
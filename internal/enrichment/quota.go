@@ -0,0 +1,149 @@
+package enrichment
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limit headers sent by agify, genderize and nationalize.
+const (
+	RateLimitLimitHeader     = "X-Rate-Limit-Limit"
+	RateLimitRemainingHeader = "X-Rate-Limit-Remaining"
+	// RateLimitResetHeader is the number of seconds until the quota is reset.
+	RateLimitResetHeader = "X-Rate-Limit-Reset"
+)
+
+// ErrQuotaExhausted matches errors of providers that ran out of quota.
+var ErrQuotaExhausted = errors.New("provider quota is exhausted")
+
+// QuotaError is returned instead of calling a provider whose quota is exhausted.
+type QuotaError struct {
+	Provider string
+	ResetAt  time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s: %s until %s", e.Provider, ErrQuotaExhausted, e.ResetAt.Format(time.RFC3339))
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExhausted
+}
+
+// Quota is what the last response of a provider told about its quota, unknown values are nil.
+type Quota struct {
+	Provider  string     `json:"provider"`
+	Limit     *int       `json:"limit"`
+	Remaining *int       `json:"remaining"`
+	ResetAt   *time.Time `json:"reset_at"`
+	Exhausted bool       `json:"exhausted"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// QuotaTracker reports the quotas of all providers.
+type QuotaTracker interface {
+	Quotas() []Quota
+}
+
+// quotaTracker follows the rate limit headers of provider responses, so providers are not called
+// once their quota is gone.
+type quotaTracker struct {
+	mu     sync.Mutex
+	quotas map[string]*Quota
+}
+
+func newQuotaTracker(providers ...string) *quotaTracker {
+	t := &quotaTracker{
+		quotas: make(map[string]*Quota, len(providers)),
+	}
+	for _, provider := range providers {
+		t.quotas[provider] = &Quota{Provider: provider}
+	}
+
+	return t
+}
+
+// check returns a QuotaError if the quota of the provider is exhausted and not reset yet.
+func (t *quotaTracker) check(provider string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	q, ok := t.quotas[provider]
+	if !ok || !q.Exhausted {
+		return nil
+	}
+
+	if time.Now().After(*q.ResetAt) {
+		q.Exhausted = false
+		q.Remaining = nil
+		return nil
+	}
+
+	return &QuotaError{Provider: provider, ResetAt: *q.ResetAt}
+}
+
+// update records the rate limit headers of a response. 429 exhausts the quota even without them,
+// a daily quota without a known reset time is assumed to be reset at midnight UTC.
+func (t *quotaTracker) update(provider string, resp *http.Response) {
+	now := time.Now()
+	limit, hasLimit := intHeader(resp.Header, RateLimitLimitHeader)
+	remaining, hasRemaining := intHeader(resp.Header, RateLimitRemainingHeader)
+	reset, hasReset := intHeader(resp.Header, RateLimitResetHeader)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	q, ok := t.quotas[provider]
+	if !ok {
+		q = &Quota{Provider: provider}
+		t.quotas[provider] = q
+	}
+
+	if hasLimit {
+		q.Limit = &limit
+	}
+	if hasRemaining {
+		q.Remaining = &remaining
+	}
+	if hasReset {
+		resetAt := now.Add(time.Duration(reset) * time.Second)
+		q.ResetAt = &resetAt
+	}
+	q.UpdatedAt = &now
+
+	q.Exhausted = resp.StatusCode == http.StatusTooManyRequests || hasRemaining && remaining <= 0
+	if q.Exhausted && (q.ResetAt == nil || !q.ResetAt.After(now)) {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		q.ResetAt = &midnight
+	}
+}
+
+func (t *quotaTracker) Quotas() []Quota {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	quotas := make([]Quota, 0, len(t.quotas))
+	for _, q := range t.quotas {
+		quotas = append(quotas, *q)
+	}
+	slices.SortFunc(quotas, func(a, b Quota) int {
+		return cmp.Compare(a.Provider, b.Provider)
+	})
+
+	return quotas
+}
+
+func intHeader(header http.Header, key string) (int, bool) {
+	val, err := strconv.Atoi(header.Get(key))
+	if err != nil {
+		return 0, false
+	}
+
+	return val, true
+}
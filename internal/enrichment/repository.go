@@ -0,0 +1,131 @@
+package enrichment
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/postgresql"
+)
+
+var errCacheMiss = errors.New("cache miss")
+
+type cacheStorage interface {
+	getCached(ctx context.Context, name string) (*Result, time.Time, error)
+	saveCached(ctx context.Context, name string, res *Result) (time.Time, error)
+}
+
+type repository struct {
+	log  *slog.Logger
+	pool *pgxpool.Pool
+}
+
+func newRepository(logger *slog.Logger, pool *pgxpool.Pool) cacheStorage {
+	return &repository{
+		log:  logger,
+		pool: pool,
+	}
+}
+
+func (r *repository) getCached(ctx context.Context, name string) (*Result, time.Time, error) {
+	query := `
+		SELECT age, age_count, gender, gender_probability, gender_count, countries, nationality_count, unknown, fetched_at
+		FROM effective.public.enrichment_cache
+		WHERE name = $1
+	`
+
+	age := AgeRequestDto{Name: name}
+	gender := GenderRequestDto{Name: name}
+	nationality := NationalityRequestDto{Name: name}
+	var unknown []string
+	var fetchedAt time.Time
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	err := r.pool.QueryRow(ctx, query, name).Scan(
+		&age.Age, &age.Count,
+		&gender.Gender, &gender.Probability, &gender.Count,
+		&nationality.Country, &nationality.Count,
+		&unknown, &fetchedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, time.Time{}, errCacheMiss
+		}
+		logger.Error(r.log, "error during scanning", err)
+		return nil, time.Time{}, err
+	}
+
+	res := &Result{Unknown: unknown}
+	if !slices.Contains(unknown, ProviderAge) {
+		res.Age = &age
+	}
+	if !slices.Contains(unknown, ProviderGender) {
+		res.Gender = &gender
+	}
+	if !slices.Contains(unknown, ProviderNationality) {
+		res.Nationality = &nationality
+	}
+
+	return res, fetchedAt, nil
+}
+
+// saveCached stores a complete result, the fields of providers listed in Unknown are stored empty.
+func (r *repository) saveCached(ctx context.Context, name string, res *Result) (time.Time, error) {
+	query := `
+		INSERT INTO enrichment_cache (name, age, age_count, gender, gender_probability, gender_count, countries, nationality_count, unknown, fetched_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now())
+		ON CONFLICT (name) DO UPDATE
+		SET age = excluded.age,
+			age_count = excluded.age_count,
+			gender = excluded.gender,
+			gender_probability = excluded.gender_probability,
+			gender_count = excluded.gender_count,
+			countries = excluded.countries,
+			nationality_count = excluded.nationality_count,
+			unknown = excluded.unknown,
+			fetched_at = excluded.fetched_at
+		RETURNING fetched_at
+	`
+
+	var age AgeRequestDto
+	if res.Age != nil {
+		age = *res.Age
+	}
+	var gender GenderRequestDto
+	if res.Gender != nil {
+		gender = *res.Gender
+	}
+	var nationality NationalityRequestDto
+	if res.Nationality != nil {
+		nationality = *res.Nationality
+	}
+	if nationality.Country == nil {
+		nationality.Country = []Country{}
+	}
+	unknown := res.Unknown
+	if unknown == nil {
+		unknown = []string{}
+	}
+
+	var fetchedAt time.Time
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	err := r.pool.QueryRow(ctx, query,
+		name,
+		age.Age, age.Count,
+		gender.Gender, gender.Probability, gender.Count,
+		nationality.Country, nationality.Count,
+		unknown,
+	).Scan(&fetchedAt)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return time.Time{}, err
+	}
+
+	return fetchedAt, nil
+}
@@ -0,0 +1,52 @@
+package enrichment
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/names"
+)
+
+// transliterator rewrites Cyrillic names into Latin before asking the wrapped enricher,
+// the providers only know Latin spellings.
+type transliterator struct {
+	log    *slog.Logger
+	next   Enricher
+	scheme names.Scheme
+}
+
+func NewTransliterator(logger *slog.Logger, next Enricher, scheme names.Scheme) Enricher {
+	return &transliterator{
+		log:    logger,
+		next:   next,
+		scheme: scheme,
+	}
+}
+
+// Enrich looks the transliterated name up, the key is returned in Result.Key.
+func (t *transliterator) Enrich(ctx context.Context, name string) (*Result, error) {
+	key := lookupKey(name, t.scheme)
+	if key != strings.TrimSpace(name) {
+		t.log.Debug("name transliterated", slog.String("name", name), slog.String("key", key), slog.String("scheme", t.scheme.String()))
+	}
+
+	res, err := t.next.Enrich(ctx, key)
+	if res == nil {
+		return nil, err
+	}
+
+	res.Key = key
+
+	return res, err
+}
+
+// lookupKey is the name that is sent to the providers for the given first name.
+func lookupKey(name string, scheme names.Scheme) string {
+	name = strings.TrimSpace(name)
+	if !names.HasCyrillic(name) {
+		return name
+	}
+
+	return names.Transliterate(name, scheme)
+}
@@ -17,12 +17,19 @@ type Handler interface {
 	RegisterRoutes(engine *gin.Engine)
 }
 
-func Run(log *slog.Logger, usersHandler Handler) {
+// Run serves the handlers, adminTokens are the bearer tokens allowed to use admin features.
+func Run(log *slog.Logger, adminTokens []string, handlers ...Handler) {
 	engine := gin.Default()
+	// handlers pass *gin.Context on, values of the request context have to be visible through it
+	engine.ContextWithFallback = true
 	engine.Use(CORSMiddleware())
+	engine.Use(RequestIDMiddleware())
+	engine.Use(AdminsMiddleware(adminTokens))
 
 	registerGinRoutes(engine)
-	usersHandler.RegisterRoutes(engine)
+	for _, h := range handlers {
+		h.RegisterRoutes(engine)
+	}
 
 	err := engine.Run(":8080")
 	if err != nil {
@@ -1,13 +1,29 @@
 package httpserver
 
-import "github.com/gin-gonic/gin"
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ActorHeader     = "X-Actor"
+	RequestIDHeader = "X-Request-ID"
+)
+
+const adminKey = "admin"
 
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, X-Actor, X-Request-ID, If-Match, If-None-Match, Prefer, Idempotency-Key, Authorization, accept, origin, Cache-Control, X-Requested-With")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag, Location, Link, X-Request-ID, Preference-Applied, Idempotent-Replayed, Retry-After")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -17,3 +33,87 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// Actor identifies who performs the request, there is no authentication so clients introduce themselves.
+func Actor(c *gin.Context) string {
+	if actor := c.GetHeader(ActorHeader); actor != "" {
+		return actor
+	}
+
+	return "anonymous"
+}
+
+// AdminsMiddleware marks requests sent with Authorization: Bearer and one of the tokens as admin ones.
+// The actor header is not trusted for it, anyone can send it.
+func AdminsMiddleware(tokens []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(adminKey, isAdminToken(tokens, c.GetHeader("Authorization")))
+		c.Next()
+	}
+}
+
+func isAdminToken(tokens []string, authorization string) bool {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+
+	token = strings.TrimSpace(token)
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsAdmin reports whether the request is authorized with an admin token.
+func IsAdmin(c *gin.Context) bool {
+	return c.GetBool(adminKey)
+}
+
+type requestIDKey struct{}
+
+// RequestIDMiddleware keeps the request id sent by the client or generates one,
+// it is echoed in the response and stored in the request context.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" {
+			b := make([]byte, 16)
+			_, _ = rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+// WithRequestID returns a copy of ctx carrying the request id, so work done later on
+// behalf of a request can be traced back to it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the id of the request ctx belongs to, it is empty outside of requests.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// PreferAsync reports whether the client asked for asynchronous processing with Prefer: respond-async (RFC 7240).
+func PreferAsync(c *gin.Context) bool {
+	for _, header := range c.Request.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			token, _, _ := strings.Cut(strings.TrimSpace(pref), ";")
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,27 @@
+package jobs
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+type Job struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`
+	Key       string          `json:"key,omitempty"`
+	Payload   json.RawMessage `json:"payload" swaggertype:"object"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	Error     *string         `json:"error,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty" swaggertype:"object"`
+	Progress  json.RawMessage `json:"progress,omitempty" swaggertype:"object"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
@@ -0,0 +1,60 @@
+package jobs
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/httpserver"
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+)
+
+type handler struct {
+	log   *slog.Logger
+	queue Queue
+}
+
+func NewHandler(logger *slog.Logger, queue Queue) httpserver.Handler {
+	h := &handler{
+		log:   logger,
+		queue: queue,
+	}
+
+	return h
+}
+
+func (h *handler) RegisterRoutes(engine *gin.Engine) {
+	group := engine.Group("/jobs")
+
+	group.GET("/:id", h.getJob)
+}
+
+// @Summary Get job
+// @Description Endpoint for getting status of a background job
+// @Produce application/json
+// @Success 200 {object} Job
+// @Param id path string true "id"
+// @Router /jobs/{id} [get]
+func (h *handler) getJob(ctx *gin.Context) {
+	id := ctx.Param("id")
+	h.log.Debug("got id param", slog.String("id", id))
+
+	job, err := h.queue.Get(ctx, id)
+	if err != nil {
+		logger.Error(h.log, "error during db query", err)
+		if errors.Is(err, ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	ctx.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,312 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+)
+
+const (
+	DefaultWorkers      = 2
+	DefaultPollInterval = time.Second
+	DefaultMaxAttempts  = 5
+	DefaultLease        = 5 * time.Minute
+
+	maxBackoff = time.Hour
+)
+
+// Func processes a job payload, the returned value is stored as the job result.
+type Func func(ctx context.Context, payload json.RawMessage) (any, error)
+
+// permanentError is a job error retrying does not fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as final, the job fails right away instead of being retried.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type (
+	progressKey struct{}
+	idKey       struct{}
+)
+
+// ID returns the id of the job ctx belongs to, it is empty outside of jobs.
+// A function can key what it stores by it to find the work of a previous attempt.
+func ID(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
+
+// ReportProgress stores the progress of the job ctx belongs to and extends its lease,
+// long running functions should call it regularly. It does nothing outside of jobs.
+// ErrLeaseLost means the job was claimed by another worker, the function should stop.
+func ReportProgress(ctx context.Context, progress any) error {
+	report, ok := ctx.Value(progressKey{}).(func(any) error)
+	if !ok {
+		return nil
+	}
+
+	return report(progress)
+}
+
+type Queue interface {
+	// Enqueue adds a job, key deduplicates unfinished jobs of the same kind (empty key disables it).
+	Enqueue(ctx context.Context, kind, key string, payload any) (*Job, error)
+	Get(ctx context.Context, id string) (*Job, error)
+	Register(kind string, fn Func)
+	// Run consumes jobs until ctx is cancelled.
+	Run(ctx context.Context)
+}
+
+type config struct {
+	workers      int
+	pollInterval time.Duration
+	maxAttempts  int
+	lease        time.Duration
+}
+
+func NewConfig(workers int, pollInterval time.Duration, maxAttempts int) *config {
+	cfg := &config{
+		workers:      workers,
+		pollInterval: pollInterval,
+		maxAttempts:  maxAttempts,
+		lease:        DefaultLease,
+	}
+
+	if cfg.workers <= 0 {
+		cfg.workers = DefaultWorkers
+	}
+	if cfg.pollInterval <= 0 {
+		cfg.pollInterval = DefaultPollInterval
+	}
+	if cfg.maxAttempts <= 0 {
+		cfg.maxAttempts = DefaultMaxAttempts
+	}
+
+	return cfg
+}
+
+type queue struct {
+	log        *slog.Logger
+	repository storage
+	cfg        *config
+
+	mu    sync.RWMutex
+	funcs map[string]Func
+}
+
+func New(logger *slog.Logger, pool *pgxpool.Pool, cfg *config) Queue {
+	return &queue{
+		log:        logger,
+		repository: newRepository(logger, pool),
+		cfg:        cfg,
+		funcs:      make(map[string]Func),
+	}
+}
+
+func (q *queue) Enqueue(ctx context.Context, kind, key string, payload any) (*Job, error) {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := q.repository.enqueue(ctx, kind, key, bytes)
+	if err != nil {
+		return nil, err
+	}
+	q.log.Info("job enqueued", slog.String("id", job.ID), slog.String("kind", kind))
+
+	return job, nil
+}
+
+func (q *queue) Get(ctx context.Context, id string) (*Job, error) {
+	return q.repository.getJob(ctx, id)
+}
+
+func (q *queue) Register(kind string, fn Func) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.funcs[kind] = fn
+}
+
+func (q *queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < q.cfg.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (q *queue) work(ctx context.Context) {
+	ticker := time.NewTicker(q.cfg.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		failed, err := q.repository.failExpired(ctx, q.kinds(), q.cfg.maxAttempts)
+		if err != nil {
+			logger.Error(q.log, "error during failing expired jobs", err)
+		}
+		if failed > 0 {
+			q.log.Info("expired jobs failed", slog.Int64("count", failed))
+		}
+
+		// drain the queue before waiting for the next tick
+		for q.processNext(ctx) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNext runs a single job and reports whether one was found.
+func (q *queue) processNext(ctx context.Context) bool {
+	job, err := q.repository.claim(ctx, q.kinds(), q.cfg.lease, q.cfg.maxAttempts)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			logger.Error(q.log, "error during claiming job", err)
+		}
+		return false
+	}
+	q.log.Debug("job claimed", slog.String("id", job.ID), slog.String("kind", job.Kind), slog.Int("attempt", job.Attempts))
+
+	result, err := q.execute(ctx, job)
+	if err != nil {
+		logger.Error(q.log, "job failed", err)
+
+		var retryAt *time.Time
+		var permanent *permanentError
+		if job.Attempts < q.cfg.maxAttempts && !errors.As(err, &permanent) {
+			at := time.Now().Add(backoff(job.Attempts))
+			retryAt = &at
+		}
+
+		err = q.repository.fail(ctx, job.ID, job.Attempts, err.Error(), retryAt)
+		if err != nil {
+			logger.Error(q.log, "error during marking job failed", err)
+		}
+		return true
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		logger.Error(q.log, "error during encoding job result", err)
+	}
+
+	err = q.repository.complete(ctx, job.ID, job.Attempts, bytes)
+	if err != nil {
+		logger.Error(q.log, "error during marking job done", err)
+		return true
+	}
+	q.log.Info("job done", slog.String("id", job.ID), slog.String("kind", job.Kind))
+
+	return true
+}
+
+func (q *queue) execute(ctx context.Context, job *Job) (result any, err error) {
+	q.mu.RLock()
+	fn, ok := q.funcs[job.Kind]
+	q.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no function registered for job kind %q", job.Kind)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	// the lease is extended while the function runs, so only jobs of crashed instances are claimed again
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go q.heartbeat(ctx, job, cancel)
+
+	ctx = context.WithValue(ctx, idKey{}, job.ID)
+	ctx = context.WithValue(ctx, progressKey{}, func(progress any) error {
+		bytes, err := json.Marshal(progress)
+		if err != nil {
+			return err
+		}
+
+		return q.repository.setProgress(ctx, job.ID, job.Attempts, bytes, q.cfg.lease)
+	})
+
+	return fn(ctx, job.Payload)
+}
+
+// heartbeat extends the lease of the job every third of it until ctx is done.
+// If the job was claimed by another worker in the meantime, ctx is cancelled with ErrLeaseLost.
+func (q *queue) heartbeat(ctx context.Context, job *Job, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(q.cfg.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := q.repository.extendLease(ctx, job.ID, job.Attempts, q.cfg.lease)
+		if errors.Is(err, ErrLeaseLost) {
+			logger.Error(q.log, "job is claimed by another worker", err)
+			cancel(err)
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			logger.Error(q.log, "error during extending job lease", err)
+		}
+	}
+}
+
+func (q *queue) kinds() []string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	kinds := make([]string, 0, len(q.funcs))
+	for kind := range q.funcs {
+		kinds = append(kinds, kind)
+	}
+
+	return kinds
+}
+
+// backoff grows exponentially with the number of attempts, starting at 10 seconds and capped at maxBackoff.
+func backoff(attempts int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, maxBackoff)
+}
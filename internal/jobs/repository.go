@@ -0,0 +1,259 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/postgresql"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when an unfinished job with the same kind and key already exists.
+	ErrDuplicate = errors.New("job is already queued")
+	// ErrLeaseLost is returned when a job was claimed again after the lease of the worker running it expired.
+	ErrLeaseLost = errors.New("job lease is lost")
+)
+
+type storage interface {
+	enqueue(ctx context.Context, kind, key string, payload []byte) (*Job, error)
+	claim(ctx context.Context, kinds []string, lease time.Duration, maxAttempts int) (*Job, error)
+	failExpired(ctx context.Context, kinds []string, maxAttempts int) (int64, error)
+	complete(ctx context.Context, id string, attempts int, result []byte) error
+	fail(ctx context.Context, id string, attempts int, reason string, retryAt *time.Time) error
+	setProgress(ctx context.Context, id string, attempts int, progress []byte, lease time.Duration) error
+	extendLease(ctx context.Context, id string, attempts int, lease time.Duration) error
+	getJob(ctx context.Context, id string) (*Job, error)
+}
+
+type repository struct {
+	log  *slog.Logger
+	pool *pgxpool.Pool
+}
+
+func newRepository(logger *slog.Logger, pool *pgxpool.Pool) storage {
+	return &repository{
+		log:  logger,
+		pool: pool,
+	}
+}
+
+func (r *repository) enqueue(ctx context.Context, kind, key string, payload []byte) (*Job, error) {
+	query := `
+		INSERT INTO jobs (kind, key, payload)
+		VALUES ($1, NULLIF($2, ''), $3)
+		ON CONFLICT (kind, key) WHERE status IN ('queued', 'running') DO NOTHING
+		RETURNING id, kind, COALESCE(key, ''), payload, status, attempts, error, result, progress, created_at, updated_at
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	job, err := scanJob(r.pool.QueryRow(ctx, query, kind, key, json.RawMessage(payload)))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrDuplicate
+		}
+		logger.Error(r.log, "error during execution", err)
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// claim locks the oldest runnable job of the given kinds. Jobs left running by a crashed
+// instance become runnable again once their lease expires, unless they used up maxAttempts.
+func (r *repository) claim(ctx context.Context, kinds []string, lease time.Duration, maxAttempts int) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'running',
+			attempts = attempts + 1,
+			locked_until = now() + make_interval(secs => $2),
+			updated_at = now()
+		WHERE id = (
+			SELECT id
+			FROM jobs
+			WHERE kind = ANY($1)
+			  AND ((status = 'queued' AND run_at <= now()) OR (status = 'running' AND locked_until < now()))
+			  AND attempts < $3
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, COALESCE(key, ''), payload, status, attempts, error, result, progress, created_at, updated_at
+	`
+
+	job, err := scanJob(r.pool.QueryRow(ctx, query, kinds, lease.Seconds(), maxAttempts))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		logger.Error(r.log, "error during execution", err)
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// failExpired marks failed the jobs of the given kinds whose last allowed attempt was left running
+// by a crashed instance, claim no longer picks them up.
+func (r *repository) failExpired(ctx context.Context, kinds []string, maxAttempts int) (int64, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'failed',
+			error = 'lease expired on the last attempt',
+			locked_until = NULL,
+			updated_at = now()
+		WHERE kind = ANY($1) AND status = 'running' AND locked_until < now() AND attempts >= $2
+	`
+
+	// runs on every poll like claim, so the query is not logged
+	tag, err := r.pool.Exec(ctx, query, kinds, maxAttempts)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// complete marks the job done, attempts identifies the claim it is done under.
+func (r *repository) complete(ctx context.Context, id string, attempts int, result []byte) error {
+	query := `
+		UPDATE jobs
+		SET status = 'done',
+			result = $1,
+			error = NULL,
+			locked_until = NULL,
+			updated_at = now()
+		WHERE id = $2 AND status = 'running' AND attempts = $3
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	tag, err := r.pool.Exec(ctx, query, json.RawMessage(result), id, attempts)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+// fail requeues the job at retryAt, or marks it failed for good when retryAt is nil.
+// attempts identifies the claim it failed under.
+func (r *repository) fail(ctx context.Context, id string, attempts int, reason string, retryAt *time.Time) error {
+	query := `
+		UPDATE jobs
+		SET status = CASE WHEN $2::timestamptz IS NULL THEN 'failed'::job_status ELSE 'queued'::job_status END,
+			run_at = COALESCE($2, run_at),
+			error = $1,
+			locked_until = NULL,
+			updated_at = now()
+		WHERE id = $3 AND status = 'running' AND attempts = $4
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	tag, err := r.pool.Exec(ctx, query, reason, retryAt, id, attempts)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+// setProgress stores the progress of a running job and extends its lease, attempts identifies the claim
+// the lease belongs to.
+func (r *repository) setProgress(ctx context.Context, id string, attempts int, progress []byte, lease time.Duration) error {
+	query := `
+		UPDATE jobs
+		SET progress = $1,
+			locked_until = now() + make_interval(secs => $2),
+			updated_at = now()
+		WHERE id = $3 AND status = 'running' AND attempts = $4
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	tag, err := r.pool.Exec(ctx, query, json.RawMessage(progress), lease.Seconds(), id, attempts)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+// extendLease keeps a running job locked for another lease, attempts identifies the claim it belongs to.
+func (r *repository) extendLease(ctx context.Context, id string, attempts int, lease time.Duration) error {
+	query := `
+		UPDATE jobs
+		SET locked_until = now() + make_interval(secs => $1)
+		WHERE id = $2 AND status = 'running' AND attempts = $3
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	tag, err := r.pool.Exec(ctx, query, lease.Seconds(), id, attempts)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+func (r *repository) getJob(ctx context.Context, id string) (*Job, error) {
+	query := `
+		SELECT id, kind, COALESCE(key, ''), payload, status, attempts, error, result, progress, created_at, updated_at
+		FROM effective.public.jobs
+		WHERE id = $1
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	job, err := scanJob(r.pool.QueryRow(ctx, query, id))
+	if err != nil {
+		logger.Error(r.log, "error during scanning", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func scanJob(row pgx.Row) (*Job, error) {
+	var job Job
+	var payload, result, progress []byte
+
+	err := row.Scan(&job.ID, &job.Kind, &job.Key, &payload, &job.Status, &job.Attempts, &job.Error, &result, &progress, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Payload = payload
+	job.Result = result
+	job.Progress = progress
+
+	return &job, nil
+}
@@ -5,11 +5,17 @@ import (
 
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/enrichment"
 	"github.com/romanchechyotkin/effective-mobile-test-task/internal/httpserver"
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/jobs"
 )
 
-func RegisterDomain(logger *slog.Logger, pool *pgxpool.Pool) httpserver.Handler {
+func RegisterDomain(logger *slog.Logger, pool *pgxpool.Pool, enricher enrichment.Enricher, queue jobs.Queue, idempotency *idempotencyConfig, quotaFallback string) httpserver.Handler {
 	repo := newRepository(logger, pool)
-	h := newHandler(logger, repo)
+	importer := newImporter(logger, repo, enricher)
+	queue.Register(JobReEnrich, newReEnricher(logger, repo, enricher).process)
+	queue.Register(JobImport, newImportJob(logger, repo, importer).process)
+	queue.Register(JobCreate, newCreateJob(logger, repo, enricher, quotaFallback).process)
+	h := newHandler(logger, repo, enricher, importer, queue, idempotency, quotaFallback)
 	return h
 }
@@ -1,50 +1,159 @@
 package users
 
+import "time"
+
 type UserRequestDto struct {
 	LastName   string `json:"last_name"`
 	FirstName  string `json:"first_name"`
 	SecondName string `json:"second_name,omitempty"`
 }
 
+// ImportUserDto is a row of a user import, age, gender and nationality are optional.
+type ImportUserDto struct {
+	LastName    string  `json:"last_name"`
+	FirstName   string  `json:"first_name"`
+	SecondName  string  `json:"second_name,omitempty"`
+	Age         *int    `json:"age,omitempty"`
+	Gender      *string `json:"gender,omitempty"`
+	Nationality *string `json:"nationality,omitempty"`
+}
+
 type UserResponseDto struct {
-	ID          string `json:"id"`
-	LastName    string `json:"last_name"`
-	FirstName   string `json:"first_name"`
-	SecondName  string `json:"second_name,omitempty"`
-	Age         int    `json:"age"`
-	Gender      string `json:"gender"`
-	Nationality string `json:"nationality"`
+	ID          string     `json:"id"`
+	LastName    string     `json:"last_name"`
+	FirstName   string     `json:"first_name"`
+	SecondName  string     `json:"second_name,omitempty"`
+	Age         *int       `json:"age"`
+	Gender      *string    `json:"gender"`
+	Nationality *string    `json:"nationality"`
+	Status      string     `json:"status"`
+	Version     int        `json:"version"`
+	CreatedAt   *time.Time `json:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	// Enrichment and Provenance are only filled in for single user responses.
+	Enrichment      *EnrichmentDto           `json:"enrichment,omitempty"`
+	Provenance      map[string]ProvenanceDto `json:"provenance,omitempty"`
+	FailedProviders []string                 `json:"failed_providers,omitempty"`
+	// PossibleDuplicates are ids of users with the same name, only filled in on create.
+	PossibleDuplicates []string `json:"possible_duplicates,omitempty"`
 }
 
-type UpdateUserDto struct {
-	LastName    string `json:"last_name,omitempty"`
-	FirstName   string `json:"first_name,omitempty"`
-	SecondName  string `json:"second_name,omitempty"`
-	Age         int    `json:"age,omitempty"`
-	Gender      string `json:"gender,omitempty"`
-	Nationality string `json:"nationality,omitempty"`
+// CreateJobDto is the state of a user created with Prefer: respond-async, User is set once it is done.
+// Failed attempts are retried, Error is the reason of the last one.
+type CreateJobDto struct {
+	ID        string           `json:"id"`
+	Status    string           `json:"status" enums:"queued,enriching,done,failed"`
+	Attempts  int              `json:"attempts"`
+	User      *UserResponseDto `json:"user,omitempty"`
+	Error     *string          `json:"error,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
 }
 
-type AgeRequestDto struct {
-	Count int    `json:"count"`
-	Name  string `json:"name"`
-	Age   int    `json:"age"`
+// UsersPageDto is a page of a user listing, cursors are passed back as the cursor query parameter.
+type UsersPageDto struct {
+	Data       []*UserResponseDto `json:"data"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+	PrevCursor string             `json:"prev_cursor,omitempty"`
+	Total      *int               `json:"total,omitempty"`
 }
 
-type GenderRequestDto struct {
-	Count       int     `json:"count"`
-	Name        string  `json:"name"`
-	Gender      string  `json:"gender"`
-	Probability float32 `json:"probability"`
+// SearchResultDto is a user found by name search, score is the word similarity between 0 and 1.
+type SearchResultDto struct {
+	User  *UserResponseDto `json:"user"`
+	Score float32          `json:"score"`
+}
+
+// ProvenanceDto tells where the value of a derived field came from.
+type ProvenanceDto struct {
+	Source    string    `json:"source"`
+	Actor     string    `json:"actor"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
-type NationalityRequestDto struct {
-	Count   int       `json:"count"`
-	Name    string    `json:"name"`
-	Country []Country `json:"country"`
+// EnrichmentDto describes how trustworthy the derived attributes are.
+// LookupKey is the transliterated first name that was sent to the providers.
+type EnrichmentDto struct {
+	LookupKey         *string          `json:"lookup_key,omitempty"`
+	AgeCount          *int             `json:"age_count"`
+	GenderProbability *float32         `json:"gender_probability"`
+	Nationalities     []NationalityDto `json:"nationalities"`
 }
 
-type Country struct {
+type NationalityDto struct {
 	CountryID   string  `json:"country_id"`
 	Probability float32 `json:"probability"`
 }
+
+// UpdateUserDto is a JSON Merge Patch (RFC 7396) of a user, its fields are the only updatable ones.
+// Explicit null clears second_name, age, gender and nationality.
+type UpdateUserDto struct {
+	LastName    *string `json:"last_name,omitempty"`
+	FirstName   *string `json:"first_name,omitempty"`
+	SecondName  *string `json:"second_name,omitempty"`
+	Age         *int    `json:"age,omitempty"`
+	Gender      *string `json:"gender,omitempty"`
+	Nationality *string `json:"nationality,omitempty"`
+}
+
+// MergeUsersDto asks to merge the source user into the target one, the source user is deleted.
+// Fields maps a field name to its resolution strategy, Strategy applies to the rest.
+type MergeUsersDto struct {
+	SourceID string            `json:"source_id"`
+	Strategy string            `json:"strategy,omitempty" enums:"keep_target,keep_source,prefer_manual"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+// UserSnapshotDto is the state of a user stored in its history.
+// Provenance is missing in snapshots taken before it was recorded.
+type UserSnapshotDto struct {
+	LastName    string                   `json:"last_name"`
+	FirstName   string                   `json:"first_name"`
+	SecondName  *string                  `json:"second_name"`
+	Age         *int                     `json:"age"`
+	Gender      *string                  `json:"gender"`
+	Nationality *string                  `json:"nationality"`
+	Status      string                   `json:"status"`
+	DeletedAt   *time.Time               `json:"deleted_at"`
+	Provenance  map[string]ProvenanceDto `json:"provenance,omitempty"`
+}
+
+// HistoryEntryDto is a version of a user with the operation that produced it.
+type HistoryEntryDto struct {
+	Version   int              `json:"version"`
+	Operation string           `json:"operation"`
+	Snapshot  *UserSnapshotDto `json:"snapshot"`
+	Actor     string           `json:"actor"`
+	RequestID string           `json:"request_id,omitempty"`
+	ChangedAt time.Time        `json:"changed_at"`
+}
+
+// HistoryDiffDto lists fields that differ between two versions of a user.
+type HistoryDiffDto struct {
+	From    int                       `json:"from"`
+	To      int                       `json:"to"`
+	Changes map[string]FieldChangeDto `json:"changes"`
+}
+
+type FieldChangeDto struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// ImportReportDto is the result of a user import, rows are listed in the order of the upload.
+// Error is set when the upload could not be read to the end, the rows before it are imported.
+type ImportReportDto struct {
+	Total   int            `json:"total"`
+	Created int            `json:"created"`
+	Failed  int            `json:"failed"`
+	Error   string         `json:"error,omitempty"`
+	Rows    []ImportRowDto `json:"rows,omitempty"`
+}
+
+// ImportRowDto is the outcome of a single row, Row is its line in the upload.
+type ImportRowDto struct {
+	Row    int    `json:"row"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
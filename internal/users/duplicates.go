@@ -0,0 +1,51 @@
+package users
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ways to handle possible duplicates on create, chosen by the on_duplicate query parameter.
+const (
+	DuplicatesWarn   = "warn"
+	DuplicatesReject = "reject"
+)
+
+const (
+	// duplicateThreshold is the minimal trigram similarity of transliterated full names for a fuzzy match.
+	duplicateThreshold = 0.6
+	maxDuplicates      = 10
+)
+
+type duplicateCheck struct {
+	mode  string
+	fuzzy bool
+}
+
+// parseDuplicateCheck reads on_duplicate and fuzzy_duplicates query parameters.
+// Duplicates only produce a warning by default and are matched by exact transliterated names.
+func parseDuplicateCheck(ctx *gin.Context) (*duplicateCheck, error) {
+	check := &duplicateCheck{
+		mode: DuplicatesWarn,
+	}
+
+	switch val := ctx.Query("on_duplicate"); val {
+	case "":
+	case DuplicatesWarn, DuplicatesReject:
+		check.mode = val
+	default:
+		return nil, fmt.Errorf("on_duplicate must be %s or %s, got %q", DuplicatesWarn, DuplicatesReject, val)
+	}
+
+	if val := ctx.Query("fuzzy_duplicates"); val != "" {
+		var err error
+		check.fuzzy, err = strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("fuzzy_duplicates must be a boolean, got %q", val)
+		}
+	}
+
+	return check, nil
+}
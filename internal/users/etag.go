@@ -0,0 +1,57 @@
+package users
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// etag is the strong entity tag of a user version.
+func etag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// parseIfMatch returns versions listed in If-Match. Nil means the header is absent or "*",
+// so any existing version matches.
+func parseIfMatch(header string) ([]int, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+
+	var versions []int
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			return nil, fmt.Errorf("If-Match requires strong entity tags, got %s", tag)
+		}
+
+		version, err := strconv.Atoi(strings.Trim(tag, `"`))
+		if err != nil {
+			return nil, fmt.Errorf("invalid entity tag %s", tag)
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// noneMatch reports whether If-None-Match does not match the version, using weak comparison.
+func noneMatch(header string, version int) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return true
+	}
+	if header == "*" {
+		return false
+	}
+
+	current := etag(version)
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == current {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,180 @@
+package users
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/parquet"
+)
+
+// Formats of user exports.
+const (
+	ExportCSV     = "csv"
+	ExportNDJSON  = "ndjson"
+	ExportParquet = "parquet"
+)
+
+const (
+	// exportBatchSize is how many rows an export fetches from the database at once.
+	exportBatchSize = 1000
+	// exportRowGroupSize is how many rows a parquet export keeps in memory before writing them out.
+	exportRowGroupSize = 10000
+)
+
+// exportContentTypes are the content types of export formats.
+var exportContentTypes = map[string]string{
+	ExportCSV:     "text/csv; charset=utf-8",
+	ExportNDJSON:  "application/x-ndjson",
+	ExportParquet: "application/vnd.apache.parquet",
+}
+
+// exportColumns are the columns of CSV and Parquet exports.
+var exportColumns = []parquet.Column{
+	{Name: "id", Type: parquet.Int64},
+	{Name: "last_name", Type: parquet.String},
+	{Name: "first_name", Type: parquet.String},
+	{Name: "second_name", Type: parquet.String},
+	{Name: "age", Type: parquet.Int32, Optional: true},
+	{Name: "gender", Type: parquet.String, Optional: true},
+	{Name: "nationality", Type: parquet.String, Optional: true},
+	{Name: "status", Type: parquet.String},
+	{Name: "version", Type: parquet.Int32},
+	{Name: "created_at", Type: parquet.Timestamp, Optional: true},
+	{Name: "deleted_at", Type: parquet.Timestamp, Optional: true},
+}
+
+func exportFormat(format string) (string, error) {
+	switch format {
+	case ExportCSV, ExportNDJSON, ExportParquet:
+		return format, nil
+	case "":
+		return "", fmt.Errorf("format is required")
+	default:
+		return "", fmt.Errorf("format must be %s, %s or %s, got %q", ExportCSV, ExportNDJSON, ExportParquet, format)
+	}
+}
+
+// exportWriter encodes exported users one by one, close writes out what is left.
+// Nothing is written to the underlying writer before the first user or close.
+type exportWriter interface {
+	write(user *UserResponseDto) error
+	close() error
+}
+
+func newExportWriter(w io.Writer, format string) exportWriter {
+	switch format {
+	case ExportCSV:
+		return &csvExporter{w: csv.NewWriter(w)}
+	case ExportParquet:
+		return &parquetExporter{w: parquet.NewWriter(w, exportColumns, exportRowGroupSize)}
+	default:
+		return &ndjsonExporter{encoder: json.NewEncoder(w)}
+	}
+}
+
+type csvExporter struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (e *csvExporter) write(user *UserResponseDto) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	return e.w.Write([]string{
+		user.ID,
+		user.LastName,
+		user.FirstName,
+		user.SecondName,
+		csvValue(valueOf(user.Age)),
+		csvValue(valueOf(user.Gender)),
+		csvValue(valueOf(user.Nationality)),
+		user.Status,
+		strconv.Itoa(user.Version),
+		csvValue(valueOf(user.CreatedAt)),
+		csvValue(valueOf(user.DeletedAt)),
+	})
+}
+
+func (e *csvExporter) writeHeader() error {
+	if e.headerWritten {
+		return nil
+	}
+	e.headerWritten = true
+
+	header := make([]string, len(exportColumns))
+	for i, column := range exportColumns {
+		header[i] = column.Name
+	}
+
+	return e.w.Write(header)
+}
+
+func (e *csvExporter) close() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExporter struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonExporter) write(user *UserResponseDto) error {
+	return e.encoder.Encode(user)
+}
+
+func (e *ndjsonExporter) close() error {
+	return nil
+}
+
+type parquetExporter struct {
+	w *parquet.Writer
+}
+
+func (e *parquetExporter) write(user *UserResponseDto) error {
+	id, err := strconv.ParseInt(user.ID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("user id %q is not an integer", user.ID)
+	}
+
+	return e.w.Write(
+		id,
+		user.LastName,
+		user.FirstName,
+		user.SecondName,
+		valueOf(user.Age),
+		valueOf(user.Gender),
+		valueOf(user.Nationality),
+		user.Status,
+		user.Version,
+		valueOf(user.CreatedAt),
+		valueOf(user.DeletedAt),
+	)
+}
+
+func (e *parquetExporter) close() error {
+	return e.w.Close()
+}
+
+// csvValue formats a value of an optional field, nil gives an empty field.
+func csvValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,232 @@
+package users
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// nameColumns can be searched with <column>_prefix and <column>_contains query parameters.
+var nameColumns = []string{"last_name", "first_name", "second_name"}
+
+type nameMatch struct {
+	column   string
+	pattern  string
+	contains bool
+}
+
+// usersFilter narrows user listings, nil and empty fields are not applied.
+type usersFilter struct {
+	gender        *string
+	nationalities []string
+	ageMin        *int
+	ageMax        *int
+	names         []nameMatch
+	createdAfter  *time.Time
+	createdBefore *time.Time
+
+	minGenderProbability      *float32
+	minAgeCount               *int
+	minNationalityProbability *float32
+
+	// includeDeleted lists soft deleted users too, it is only allowed for admins.
+	includeDeleted bool
+}
+
+func parseUsersFilter(ctx *gin.Context) (*usersFilter, error) {
+	var filter usersFilter
+	var err error
+
+	if val := ctx.Query("gender"); val != "" {
+		if err = validateGender(val); err != nil {
+			return nil, err
+		}
+		filter.gender = &val
+	}
+
+	for _, val := range ctx.QueryArray("nationality") {
+		for _, code := range strings.Split(val, ",") {
+			code = strings.ToUpper(strings.TrimSpace(code))
+			if err = validateNationality(code); err != nil {
+				return nil, err
+			}
+			filter.nationalities = append(filter.nationalities, code)
+		}
+	}
+
+	filter.ageMin, err = parseInt(ctx, "age_min")
+	if err != nil {
+		return nil, err
+	}
+
+	filter.ageMax, err = parseInt(ctx, "age_max")
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.ageMin != nil && filter.ageMax != nil && *filter.ageMin > *filter.ageMax {
+		return nil, fmt.Errorf("age_min must not be greater than age_max")
+	}
+
+	for _, column := range nameColumns {
+		if val := ctx.Query(column + "_prefix"); val != "" {
+			filter.names = append(filter.names, nameMatch{column: column, pattern: val})
+		}
+		if val := ctx.Query(column + "_contains"); val != "" {
+			filter.names = append(filter.names, nameMatch{column: column, pattern: val, contains: true})
+		}
+	}
+
+	filter.createdAfter, err = parseTime(ctx, "created_after")
+	if err != nil {
+		return nil, err
+	}
+
+	filter.createdBefore, err = parseTime(ctx, "created_before")
+	if err != nil {
+		return nil, err
+	}
+
+	filter.minGenderProbability, err = parseProbability(ctx, "min_gender_probability")
+	if err != nil {
+		return nil, err
+	}
+
+	filter.minNationalityProbability, err = parseProbability(ctx, "min_nationality_probability")
+	if err != nil {
+		return nil, err
+	}
+
+	filter.minAgeCount, err = parseInt(ctx, "min_age_count")
+	if err != nil {
+		return nil, err
+	}
+
+	if val := ctx.Query("include_deleted"); val != "" {
+		filter.includeDeleted, err = strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("include_deleted must be a boolean, got %q", val)
+		}
+	}
+
+	return &filter, nil
+}
+
+// conditions renders the filter as SQL conditions over the users table, values are added to args.
+func (f *usersFilter) conditions(args *queryArgs) []string {
+	var conds []string
+
+	if !f.includeDeleted {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if f.gender != nil {
+		conds = append(conds, "gender = "+args.add(*f.gender))
+	}
+	if len(f.nationalities) != 0 {
+		conds = append(conds, "nationality = ANY("+args.add(f.nationalities)+")")
+	}
+	if f.ageMin != nil {
+		conds = append(conds, "age >= "+args.add(*f.ageMin))
+	}
+	if f.ageMax != nil {
+		conds = append(conds, "age <= "+args.add(*f.ageMax))
+	}
+	for _, m := range f.names {
+		pattern := escapeLike(m.pattern) + "%"
+		if m.contains {
+			pattern = "%" + pattern
+		}
+		conds = append(conds, m.column+" ILIKE "+args.add(pattern))
+	}
+	if f.createdAfter != nil {
+		conds = append(conds, "created_at >= "+args.add(*f.createdAfter))
+	}
+	if f.createdBefore != nil {
+		conds = append(conds, "created_at < "+args.add(*f.createdBefore))
+	}
+	if f.minGenderProbability != nil {
+		conds = append(conds, "gender_probability >= "+args.add(*f.minGenderProbability))
+	}
+	if f.minAgeCount != nil {
+		conds = append(conds, "age_count >= "+args.add(*f.minAgeCount))
+	}
+	if f.minNationalityProbability != nil {
+		conds = append(conds, `EXISTS (
+			SELECT 1 FROM effective.public.user_nationalities n
+			WHERE n.user_id = users.id AND n.rank = 1 AND n.probability >= `+args.add(*f.minNationalityProbability)+`
+		)`)
+	}
+
+	return conds
+}
+
+// where joins conditions into a WHERE clause, it is empty when there is nothing to filter by.
+func where(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+// queryArgs collects positional query arguments.
+type queryArgs []any
+
+// add appends the value and returns its placeholder.
+func (a *queryArgs) add(val any) string {
+	*a = append(*a, val)
+	return fmt.Sprintf("$%d", len(*a))
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func parseInt(ctx *gin.Context, key string) (*int, error) {
+	val := ctx.Query(key)
+	if val == "" {
+		return nil, nil
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil || i < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative integer, got %q", key, val)
+	}
+
+	return &i, nil
+}
+
+// parseTime accepts RFC 3339 timestamps and plain dates.
+func parseTime(ctx *gin.Context, key string) (*time.Time, error) {
+	val := ctx.Query(key)
+	if val == "" {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, val)
+		if err == nil {
+			return &t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s must be an RFC 3339 timestamp or a date, got %q", key, val)
+}
+
+func parseProbability(ctx *gin.Context, key string) (*float32, error) {
+	val := ctx.Query(key)
+	if val == "" {
+		return nil, nil
+	}
+
+	p, err := strconv.ParseFloat(val, 32)
+	if err != nil || p < 0 || p > 1 {
+		return nil, fmt.Errorf("%s must be a number between 0 and 1, got %q", key, val)
+	}
+
+	res := float32(p)
+	return &res, nil
+}
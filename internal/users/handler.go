@@ -1,48 +1,118 @@
 package users
 
 import (
+	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
-	"sync"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/enrichment"
 	"github.com/romanchechyotkin/effective-mobile-test-task/internal/httpserver"
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/jobs"
 	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
 )
 
 const (
-	AgeApi         = "https://api.agify.io/?name="
-	GenderApi      = "https://api.genderize.io/?name="
-	NationalityApi = "https://api.nationalize.io/?name="
+	StatusComplete = "complete"
+	StatusPending  = "pending_enrichment"
 )
 
 const (
-	SORT_BY_ASC_AGE  = "age.a"
-	SORT_BY_DESC_AGE = "age.d"
+	FieldAge         = "age"
+	FieldGender      = "gender"
+	FieldNationality = "nationality"
 )
 
+// Sources of derived field values besides the enrichment providers.
+const (
+	SourceManual = "manual"
+	SourceImport = "import"
+)
+
+// overrideSources are sources of values given by people, enrichment never replaces them.
+var overrideSources = []string{SourceManual, SourceImport}
+
+func isOverride(source string) bool {
+	return slices.Contains(overrideSources, source)
+}
+
+// ActorSystem is recorded as the actor of values set by the service itself.
+const ActorSystem = "system"
+
+const (
+	// searchThreshold is the minimal word similarity of search results, "Chechetkin" to "Chechyotkin" is about 0.57.
+	searchThreshold = 0.3
+	// phoneticScore is the score of users whose name sounds like a word of the query.
+	phoneticScore   = 0.8
+	minSearchLength = 2
+)
+
+// nationalityCandidates is how many of the most probable nationalities are stored.
+const nationalityCandidates = 3
+
 type storage interface {
-	saveUser(ctx context.Context, dto *UserResponseDto) (string, error)
-	getAllUsers(ctx context.Context, opt ...string) ([]*UserResponseDto, error)
+	// saveUser creates the user, inside of a job it is remembered as created by the job.
+	saveUser(ctx context.Context, dto *UserResponseDto, actor string) (string, error)
+	getCreatedUser(ctx context.Context, jobID string) (string, error)
+	saveUsers(ctx context.Context, dtos []*UserResponseDto, actor string) ([]string, error)
+	saveImport(ctx context.Context, upload *userImport) (string, error)
+	getImport(ctx context.Context, id string) (*userImport, error)
+	deleteImport(ctx context.Context, id string) error
+	saveImportBatch(ctx context.Context, id string, seq int, dtos []*UserResponseDto, rows []ImportRowDto, actor string) error
+	getImportRows(ctx context.Context, id string) ([]ImportRowDto, int, error)
+	claimIdempotencyKey(ctx context.Context, key, requestHash string, lease, ttl time.Duration) (bool, error)
+	getIdempotencyKey(ctx context.Context, key string) (*idempotentRequest, error)
+	saveIdempotentResponse(ctx context.Context, key string, req *idempotentRequest) error
+	releaseIdempotencyKey(ctx context.Context, key, requestHash string) error
+	deleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+	getAllUsers(ctx context.Context, filter *usersFilter, page *pageRequest) ([]*UserResponseDto, error)
+	countUsers(ctx context.Context, filter *usersFilter) (int, error)
+	exportUsers(ctx context.Context, filter *usersFilter, fn func(*UserResponseDto) error) error
+	searchUsers(ctx context.Context, q string, threshold float32, limit int) ([]*SearchResultDto, error)
+	findDuplicates(ctx context.Context, dto *UserRequestDto, fuzzy bool, limit int) ([]string, error)
 	getUser(ctx context.Context, id string) (*UserResponseDto, error)
-	updateUser(ctx context.Context, id, col string, val any) error
-	deleteUser(ctx context.Context, id string) error
+	getUsersToReEnrich(ctx context.Context, cfg *schedulerConfig, limit int) ([]string, error)
+	saveEnrichment(ctx context.Context, dto *UserResponseDto) error
+	updateUser(ctx context.Context, id string, changes map[string]any, actor string, versions []int) error
+	deleteUser(ctx context.Context, id, actor string, versions []int) error
+	restoreUser(ctx context.Context, id, actor string, versions []int) error
+	purgeUser(ctx context.Context, id, actor string, versions []int) error
+	mergeUsers(ctx context.Context, target, source *UserResponseDto, changes map[string]any, actor string) error
+	getHistory(ctx context.Context, id string) ([]*HistoryEntryDto, error)
+	getHistoryEntry(ctx context.Context, id string, version int) (*HistoryEntryDto, error)
+	revertUser(ctx context.Context, id string, version int, actor string, versions []int) error
 }
 
 type handler struct {
-	log        *slog.Logger
-	repository storage
+	log         *slog.Logger
+	repository  storage
+	enricher    enrichment.Enricher
+	importer    *importer
+	queue       jobs.Queue
+	idempotency *idempotencyConfig
+	// quotaFallback is how creates are handled while the quota of a provider is exhausted.
+	quotaFallback string
 }
 
-func newHandler(logger *slog.Logger, repo storage) httpserver.Handler {
+func newHandler(logger *slog.Logger, repo storage, enricher enrichment.Enricher, importer *importer, queue jobs.Queue, idempotency *idempotencyConfig, quotaFallback string) httpserver.Handler {
 	h := &handler{
-		log:        logger,
-		repository: repo,
+		log:           logger,
+		repository:    repo,
+		enricher:      enricher,
+		importer:      importer,
+		queue:         queue,
+		idempotency:   idempotency,
+		quotaFallback: quotaFallback,
 	}
 
 	return h
@@ -51,22 +121,53 @@ func newHandler(logger *slog.Logger, repo storage) httpserver.Handler {
 func (h *handler) RegisterRoutes(engine *gin.Engine) {
 	group := engine.Group("/users")
 
-	group.POST("/", h.createUser)
+	group.POST("/", h.idempotent, h.createUser)
 	group.GET("/", h.getAllUsers)
+	group.GET("/search", h.searchUsers)
+	group.GET("/export", h.exportUsers)
+	group.POST("/import", h.importUsers)
+	group.GET("/jobs/:id", h.getCreateJob)
 	group.GET("/:id", h.getUser)
 	group.PATCH("/:id", h.updateUser)
 	group.DELETE("/:id", h.deleteUser)
+	group.POST("/:id/restore", h.restoreUser)
+	group.POST("/:id/re-enrich", h.reEnrichUser)
+	group.POST("/:id/merge", h.mergeUsers)
+	group.GET("/:id/history", h.getHistory)
+	group.GET("/:id/history/diff", h.diffHistory)
+	group.GET("/:id/history/:version", h.getHistoryEntry)
+	group.POST("/:id/revert", h.revertUser)
 	group.GET("/health", h.index)
 }
 
 // @Summary Create user
-// @Description Endpoint for creating and saving user to database
+// @Description Endpoint for creating and saving user to database.
+// @Description If some enrichment providers fail the user is saved with pending_enrichment status
+// @Description and failed_providers listed, the missing fields are filled in later by a background job.
+// @Description Fields of providers that have no data for the name stay empty and do not make the user pending.
+// @Description Users with the same transliterated full name are listed in possible_duplicates,
+// @Description or the request is rejected with 409 when on_duplicate is reject.
+// @Description With Prefer: respond-async the user is enriched and saved by a job after the duplicate check,
+// @Description its state is available at the returned location.
+// @Description Retries with the same Idempotency-Key get the response of the first request with Idempotent-Replayed: true,
+// @Description a retry of a request in progress waits for it or gets 409.
+// @Description While the quota of a provider is exhausted the user is saved as pending_enrichment,
+// @Description or the request is rejected with 503 and Retry-After if ENRICHMENT_QUOTA_FALLBACK is reject.
+// @Description Asynchronous creates rejected that way end up failed with the quota error.
 // @Produce application/json
+// @Param on_duplicate query string false "warn (default) or reject"
+// @Param fuzzy_duplicates query boolean false "also match similar and similarly sounding names"
+// @Param Prefer header string false "respond-async to create the user in the background"
+// @Param Idempotency-Key header string false "unique key of the request, at most 255 characters"
 // @Success 201 {object} UserResponseDto
+// @Success 202 {object} CreateJobDto
+// @Failure 409 {object} map[string]any
+// @Failure 422 {object} map[string]string
+// @Failure 503 {object} map[string]string
+// @Header 202 {string} Location "/users/jobs/{job_id}"
 // @Router /users [post]
 func (h *handler) createUser(ctx *gin.Context) {
 	var userDto UserRequestDto
-	var wg sync.WaitGroup
 
 	err := ctx.ShouldBindJSON(&userDto)
 	if err != nil {
@@ -78,145 +179,466 @@ func (h *handler) createUser(ctx *gin.Context) {
 	}
 	h.log.Debug("decoded user dto", slog.Any("dto", userDto))
 
-	var ageDto AgeRequestDto
-	var genderDto GenderRequestDto
-	var nationalityDto NationalityRequestDto
+	check, err := parseDuplicateCheck(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	duplicates, err := h.repository.findDuplicates(ctx, &userDto, check.fuzzy, maxDuplicates)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if len(duplicates) > 0 && check.mode == DuplicatesReject {
+		h.log.Info("user rejected as duplicate", slog.Any("duplicates", duplicates))
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":      "user with the same name already exists",
+			"duplicates": duplicates,
+		})
+		return
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		resp, err := http.Get(fmt.Sprintf("%s%s", AgeApi, userDto.FirstName))
-		if err != nil {
-			logger.Error(h.log, "error during request to age api", err)
-			ctx.JSON(http.StatusInternalServerError, gin.H{
-				"error": err.Error(),
+	if httpserver.PreferAsync(ctx) {
+		h.createUserAsync(ctx, &createPayload{
+			User:       userDto,
+			Duplicates: duplicates,
+			Actor:      httpserver.Actor(ctx),
+			RequestID:  httpserver.RequestID(ctx),
+		})
+		return
+	}
+
+	response := &UserResponseDto{
+		LastName:           userDto.LastName,
+		FirstName:          userDto.FirstName,
+		SecondName:         userDto.SecondName,
+		PossibleDuplicates: duplicates,
+	}
+
+	enriched, err := h.enricher.Enrich(ctx.Request.Context(), userDto.FirstName)
+	if err != nil {
+		if quotaErr, ok := quotaRejection(h.quotaFallback, err); ok {
+			logger.Error(h.log, "user rejected, provider quota is exhausted", err)
+			ctx.Header("Retry-After", retryAfter(quotaErr.ResetAt))
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": quotaErr.Error(),
 			})
 			return
 		}
-		defer resp.Body.Close()
+		logger.Error(h.log, "enrichment failed, user will be saved as pending", err)
+	}
+	applyEnrichment(response, enriched)
 
-		err = json.NewDecoder(resp.Body).Decode(&ageDto)
-		if err != nil {
-			logger.Error(h.log, "error during decoding age info", err)
-			ctx.JSON(http.StatusBadRequest, gin.H{
+	id, err := h.repository.saveUser(ctx, response, httpserver.Actor(ctx))
+	if err != nil {
+		logger.Error(h.log, "error during saving user to database", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	response.ID = id
+
+	h.log.Info("user created", slog.Any("user", response))
+	ctx.JSON(http.StatusCreated, response)
+}
+
+// createUserAsync stores the create request as a job and responds with its state.
+func (h *handler) createUserAsync(ctx *gin.Context, payload *createPayload) {
+	job, err := h.queue.Enqueue(ctx, JobCreate, "", payload)
+	if err != nil {
+		logger.Error(h.log, "error during enqueueing job", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	res, err := newCreateJobDto(job)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	h.log.Info("user creation accepted", slog.String("job", job.ID))
+	ctx.Header("Preference-Applied", "respond-async")
+	ctx.Header("Location", "/users/jobs/"+job.ID)
+	ctx.JSON(http.StatusAccepted, res)
+}
+
+// @Summary Get user creation job
+// @Description Endpoint for polling a user created with Prefer: respond-async.
+// @Description The job goes from queued to enriching to done or failed, the user is included once it is done.
+// @Produce application/json
+// @Success 200 {object} CreateJobDto
+// @Failure 404 {object} map[string]string
+// @Param id path string true "job id"
+// @Router /users/jobs/{id} [get]
+func (h *handler) getCreateJob(ctx *gin.Context) {
+	id := ctx.Param("id")
+	h.log.Debug("got id param", slog.String("id", id))
+
+	job, err := h.queue.Get(ctx, id)
+	if err == nil && job.Kind != JobCreate {
+		err = jobs.ErrNotFound
+	}
+	if err != nil {
+		logger.Error(h.log, "error during db query", err)
+		if errors.Is(err, jobs.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
 				"error": err.Error(),
 			})
-			return
-		}
-		h.log.Debug("decoded age dto", slog.Any("dto", ageDto))
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		resp, err := http.Get(fmt.Sprintf("%s%s", GenderApi, userDto.FirstName))
-		if err != nil {
-			logger.Error(h.log, "error during request to gender api", err)
+		} else {
 			ctx.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
 			})
-			return
 		}
-		defer resp.Body.Close()
+		return
+	}
 
-		err = json.NewDecoder(resp.Body).Decode(&genderDto)
-		if err != nil {
-			logger.Error(h.log, "error during decoding gender info", err)
-			ctx.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
-			return
-		}
-		h.log.Debug("decoded gender dto", slog.Any("dto", genderDto))
-	}()
+	res, err := newCreateJobDto(job)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+// @Summary Import users
+// @Description Endpoint for creating users from a CSV file with last_name, first_name and optional second_name,
+// @Description age, gender and nationality columns or from NDJSON with such a user object per line. Given age, gender
+// @Description and nationality are kept with import provenance instead of enriched ones. Rows are validated and enriched one by one,
+// @Description failed rows are listed in the report and do not stop the import.
+// @Description Uploads larger than 1 MiB or sent with Prefer: respond-async are imported by a job,
+// @Description its progress and report are available at the returned location.
+// @Accept text/csv
+// @Accept application/x-ndjson
+// @Produce application/json
+// @Param format query string false "csv or ndjson, taken from Content-Type by default"
+// @Param Prefer header string false "respond-async to import in the background"
+// @Param X-Actor header string false "who performs the import"
+// @Success 200 {object} ImportReportDto
+// @Success 202 {object} jobs.Job
+// @Failure 413 {object} map[string]string
+// @Header 202 {string} Location "/jobs/{job_id}"
+// @Router /users/import [post]
+func (h *handler) importUsers(ctx *gin.Context) {
+	format, err := importFormat(ctx.Query("format"), ctx.ContentType())
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// the size is told by the bytes read, chunked uploads come without Content-Length
+	body := bufio.NewReaderSize(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxImportSize), maxSyncImportSize+1)
+	_, err = body.Peek(maxSyncImportSize + 1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		logger.Error(h.log, "error during reading import", err)
+		h.importFailed(ctx, err)
+		return
+	}
+	large := err == nil
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		resp, err := http.Get(fmt.Sprintf("%s%s", NationalityApi, userDto.FirstName))
+	if httpserver.PreferAsync(ctx) || large {
+		id, err := h.repository.saveImport(ctx, &userImport{format: format, actor: httpserver.Actor(ctx), data: body})
 		if err != nil {
-			logger.Error(h.log, "error during request to nationality api", err)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				h.importFailed(ctx, err)
+				return
+			}
 			ctx.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
 			})
 			return
 		}
-		defer resp.Body.Close()
 
-		err = json.NewDecoder(resp.Body).Decode(&nationalityDto)
+		job, err := h.queue.Enqueue(ctx, JobImport, id, importPayload{ImportID: id})
 		if err != nil {
-			logger.Error(h.log, "error during decoding nationality info", err)
-			ctx.JSON(http.StatusBadRequest, gin.H{
+			logger.Error(h.log, "error during enqueueing job", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
 			})
 			return
 		}
-		h.log.Debug("decoded nationality dto", slog.Any("dto", nationalityDto))
-	}()
 
-	wg.Wait()
+		ctx.Header("Preference-Applied", "respond-async")
+		ctx.Header("Location", "/jobs/"+job.ID)
+		ctx.JSON(http.StatusAccepted, job)
+		return
+	}
 
-	response := &UserResponseDto{
-		LastName:    userDto.LastName,
-		FirstName:   userDto.FirstName,
-		SecondName:  userDto.SecondName,
-		Age:         ageDto.Age,
-		Gender:      genderDto.Gender,
-		Nationality: nationalityDto.Country[0].CountryID,
+	next, err := newRowReader(body, format)
+	if err != nil {
+		h.importFailed(ctx, err)
+		return
 	}
 
-	id, err := h.repository.saveUser(ctx, response)
+	report, err := h.importer.run(ctx, next, httpserver.Actor(ctx), nil)
 	if err != nil {
-		logger.Error(h.log, "error during saving user to database", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"error": err.Error(),
-		})
+		logger.Error(h.log, "import stopped early", err)
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		ctx.JSON(status, report)
 		return
 	}
 
-	response.ID = id
+	h.log.Info("users imported", slog.Int("created", report.Created), slog.Int("failed", report.Failed))
+	ctx.JSON(http.StatusOK, report)
+}
 
-	h.log.Info("user created", slog.Any("user", response))
-	ctx.JSON(http.StatusCreated, response)
+// importFailed responds to an upload that could not be read.
+func (h *handler) importFailed(ctx *gin.Context, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("import must not be larger than %d bytes", maxBytesErr.Limit),
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusBadRequest, gin.H{
+		"error": err.Error(),
+	})
 }
 
 // @Summary All users
-// @Description Endpoint for getting all users
+// @Description Endpoint for getting all users, all given filters are combined
 // @Produce application/json
-// @Success 200 {object} []UserResponseDto{}
+// @Param gender query string false "male or female"
+// @Param nationality query []string false "ISO 3166-1 alpha-2 country codes" collectionFormat(multi)
+// @Param age_min query integer false "minimal age, inclusive"
+// @Param age_max query integer false "maximal age, inclusive"
+// @Param last_name_prefix query string false "case-insensitive last name prefix"
+// @Param last_name_contains query string false "case-insensitive last name substring"
+// @Param first_name_prefix query string false "case-insensitive first name prefix"
+// @Param first_name_contains query string false "case-insensitive first name substring"
+// @Param second_name_prefix query string false "case-insensitive second name prefix"
+// @Param second_name_contains query string false "case-insensitive second name substring"
+// @Param created_after query string false "RFC 3339 timestamp or date, inclusive"
+// @Param created_before query string false "RFC 3339 timestamp or date, exclusive"
+// @Param min_gender_probability query number false "minimal gender probability, 0..1"
+// @Param min_age_count query integer false "minimal agify sample size"
+// @Param min_nationality_probability query number false "minimal probability of the top nationality, 0..1"
+// @Param sort query string false "comma separated columns, minus for descending: id, last_name, first_name, second_name, gender, nationality, age, created_at (default)" example(nationality,-age,last_name)
+// @Param limit query integer false "page size, 20 by default, at most 100"
+// @Param cursor query string false "next_cursor or prev_cursor of a previous page"
+// @Param total query boolean false "count all users matching the filters"
+// @Param include_deleted query boolean false "list deleted users too, admins only"
+// @Security AdminToken
+// @Success 200 {object} UsersPageDto
+// @Failure 403 {object} map[string]string
+// @Header 200 {string} Link "RFC 8288 links to the next and previous pages"
 // @Router /users [get]
 func (h *handler) getAllUsers(ctx *gin.Context) {
-	sort := ctx.Query("sort")
-	limit := ctx.Query("limit")
-	h.log.Debug("got sort query value", slog.String("sort", sort))
-	h.log.Debug("got limit query value", slog.String("limit", limit))
+	h.log.Debug("got list query", slog.String("query", ctx.Request.URL.RawQuery))
+
+	page, err := parsePageRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 
-	var users []*UserResponseDto
-	var err error
+	filter, err := parseUsersFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 
-	switch sort {
-	case SORT_BY_ASC_AGE:
-		users, err = h.repository.getAllUsers(ctx, sort, limit)
-	case SORT_BY_DESC_AGE:
-		users, err = h.repository.getAllUsers(ctx, sort, limit)
-	default:
-		users, err = h.repository.getAllUsers(ctx, sort, limit)
+	if filter.includeDeleted && !httpserver.IsAdmin(ctx) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error": "only admins can list deleted users",
+		})
+		return
 	}
 
+	users, err := h.repository.getAllUsers(ctx, filter, page)
 	if err != nil {
-		if errors.Is(err, ErrNotFound) {
-			ctx.JSON(http.StatusNotFound, gin.H{
-				"error": err.Error(),
-			})
-		} else {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	res := newUsersPage(users, page)
+
+	if page.total {
+		total, err := h.repository.countUsers(ctx, filter)
+		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
 			})
+			return
+		}
+		res.Total = &total
+	}
+
+	if link := linkHeader(ctx.Request.URL, res); link != "" {
+		ctx.Header("Link", link)
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+// @Summary Export users
+// @Description Streams all users matching the filters of the user listing ordered by id, the file is not buffered.
+// @Description An export that fails midway is cut off without the end of the response.
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Produce application/vnd.apache.parquet
+// @Param format query string true "csv, ndjson or parquet"
+// @Param gender query string false "male or female"
+// @Param nationality query []string false "ISO 3166-1 alpha-2 country codes" collectionFormat(multi)
+// @Param age_min query integer false "minimal age, inclusive"
+// @Param age_max query integer false "maximal age, inclusive"
+// @Param last_name_prefix query string false "case-insensitive last name prefix"
+// @Param last_name_contains query string false "case-insensitive last name substring"
+// @Param first_name_prefix query string false "case-insensitive first name prefix"
+// @Param first_name_contains query string false "case-insensitive first name substring"
+// @Param second_name_prefix query string false "case-insensitive second name prefix"
+// @Param second_name_contains query string false "case-insensitive second name substring"
+// @Param created_after query string false "RFC 3339 timestamp or date, inclusive"
+// @Param created_before query string false "RFC 3339 timestamp or date, exclusive"
+// @Param min_gender_probability query number false "minimal gender probability, 0..1"
+// @Param min_age_count query integer false "minimal agify sample size"
+// @Param min_nationality_probability query number false "minimal probability of the top nationality, 0..1"
+// @Param include_deleted query boolean false "export deleted users too, admins only"
+// @Security AdminToken
+// @Success 200 {file} file
+// @Failure 403 {object} map[string]string
+// @Header 200 {string} Content-Disposition "attachment; filename=users.{format}"
+// @Router /users/export [get]
+func (h *handler) exportUsers(ctx *gin.Context) {
+	format, err := exportFormat(ctx.Query("format"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	filter, err := parseUsersFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if filter.includeDeleted && !httpserver.IsAdmin(ctx) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error": "only admins can export deleted users",
+		})
+		return
+	}
+
+	ctx.Header("Content-Type", exportContentTypes[format])
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=users.%s", format))
+
+	var exported int
+	w := newExportWriter(ctx.Writer, format)
+	err = h.repository.exportUsers(ctx, filter, func(user *UserResponseDto) error {
+		exported++
+		return w.write(user)
+	})
+	if err == nil {
+		err = w.close()
+	}
+	if err != nil {
+		h.exportFailed(ctx, err)
+		return
+	}
+
+	h.log.Info("users exported", slog.String("format", format), slog.Int("users", exported))
+}
+
+// exportFailed responds with an error if nothing is sent yet, otherwise the connection is closed
+// before the end of the response, so clients do not take the partial export for a complete one.
+func (h *handler) exportFailed(ctx *gin.Context, err error) {
+	logger.Error(h.log, "export failed", err)
+
+	if !ctx.Writer.Written() {
+		ctx.Header("Content-Type", "")
+		ctx.Header("Content-Disposition", "")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	conn, _, err := ctx.Writer.Hijack()
+	if err != nil {
+		logger.Error(h.log, "error during aborting export", err)
+		return
+	}
+	conn.Close()
+}
+
+// @Summary Search users
+// @Description Endpoint for typo tolerant search of users by any part of their full name, best matches first.
+// @Description Cyrillic and Latin spellings of a name match each other, e.g. "Aleksandrovich" finds "Александрович".
+// @Produce application/json
+// @Param q query string true "part of last, first or second name"
+// @Param limit query integer false "result count, 20 by default, at most 100"
+// @Success 200 {object} []SearchResultDto
+// @Router /users/search [get]
+func (h *handler) searchUsers(ctx *gin.Context) {
+	q := strings.TrimSpace(ctx.Query("q"))
+	h.log.Debug("got search query", slog.String("q", q))
+
+	if utf8.RuneCountInString(q) < minSearchLength {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("q must be at least %d characters long", minSearchLength),
+		})
+		return
+	}
+
+	limit := defaultLimit
+	if val := ctx.Query("limit"); val != "" {
+		var err error
+		limit, err = strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > maxLimit {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("limit must be an integer between 1 and %d, got %q", maxLimit, val),
+			})
+			return
 		}
+	}
+
+	results, err := h.repository.searchUsers(ctx, q, searchThreshold, limit)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, users)
+	if results == nil {
+		results = []*SearchResultDto{}
+	}
+
+	ctx.JSON(http.StatusOK, results)
 }
 
 // @Summary Users Endpoint Health Check
@@ -232,7 +654,10 @@ func (h *handler) index(ctx *gin.Context) {
 // @Description Endpoint for getting user with exact id
 // @Produce application/json
 // @Success 200 {object} UserResponseDto
+// @Success 304
+// @Header 200 {string} ETag "version of the user"
 // @Param id path string true "id"
+// @Param If-None-Match header string false "entity tag of a cached version"
 // @Router /users/{id} [get]
 func (h *handler) getUser(ctx *gin.Context) {
 	id := ctx.Param("id")
@@ -253,39 +678,71 @@ func (h *handler) getUser(ctx *gin.Context) {
 		return
 	}
 
+	ctx.Header("ETag", etag(user.Version))
+	if !noneMatch(ctx.GetHeader("If-None-Match"), user.Version) {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
 	ctx.JSON(http.StatusOK, user)
 }
 
 // @Summary Update exact user
-// @Description Endpoint for updating user with exact id
+// @Description Endpoint for updating user with exact id using JSON Merge Patch (RFC 7396).
+// @Description All changes are applied atomically, explicit null clears second_name, age, gender and nationality.
+// @Accept application/merge-patch+json
 // @Produce application/json
-// @Success 204 {object} UserResponseDto
 // @Param id path string true "id"
+// @Param X-Actor header string false "who performs the change"
+// @Param If-Match header string false "entity tag the change is based on"
+// @Param patch body UpdateUserDto true "merge patch"
+// @Success 200 {object} UserResponseDto
+// @Failure 412 {object} map[string]string
+// @Header 200 {string} ETag "version of the updated user"
 // @Router /users/{id} [patch]
 func (h *handler) updateUser(ctx *gin.Context) {
 	id := ctx.Param("id")
 	h.log.Debug("got id param", slog.String("id", id))
 
-	var dto map[string]any
-	err := ctx.ShouldBindJSON(&dto)
+	versions, err := parseIfMatch(ctx.GetHeader("If-Match"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	body, err := ctx.GetRawData()
 	if err != nil {
-		logger.Error(h.log, "error during decoding", err)
+		logger.Error(h.log, "error during reading body", err)
 		ctx.JSON(http.StatusBadRequest, gin.H{
-			"error": err,
+			"error": err.Error(),
 		})
 		return
 	}
 
-	h.log.Debug("decoded update user dto", slog.Any("dto", dto))
+	changes, err := decodeMergePatch(body)
+	if err != nil {
+		logger.Error(h.log, "error during decoding merge patch", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	h.log.Debug("decoded merge patch", slog.Any("changes", changes))
 
-	for k, v := range dto {
-		err := h.repository.updateUser(ctx, id, k, v)
+	if len(changes) != 0 {
+		err = h.repository.updateUser(ctx, id, changes, httpserver.Actor(ctx), versions)
 		if err != nil {
 			logger.Error(h.log, "error during updating in database", err)
 			if errors.Is(err, ErrNotFound) {
 				ctx.JSON(http.StatusNotFound, gin.H{
 					"error": err.Error(),
 				})
+			} else if errors.Is(err, ErrVersionMismatch) {
+				ctx.JSON(http.StatusPreconditionFailed, gin.H{
+					"error": err.Error(),
+				})
 			} else {
 				ctx.JSON(http.StatusInternalServerError, gin.H{
 					"error": err.Error(),
@@ -295,28 +752,82 @@ func (h *handler) updateUser(ctx *gin.Context) {
 		}
 	}
 
-	ctx.JSON(http.StatusNoContent, gin.H{
-		"message": "updated successfully",
-	})
-}
-
-// @Summary Delete exact user
-// @Description Endpoint for deleting user with exact id
-// @Produce application/json
-// @Success 204 {object} UserResponseDto
+	user, err := h.repository.getUser(ctx, id)
+	if err != nil {
+		logger.Error(h.log, "error during db query", err)
+		if errors.Is(err, ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	// an empty patch changes nothing, but still has to honour If-Match
+	if len(changes) == 0 && versions != nil && !slices.Contains(versions, user.Version) {
+		ctx.JSON(http.StatusPreconditionFailed, gin.H{
+			"error": ErrVersionMismatch.Error(),
+		})
+		return
+	}
+
+	ctx.Header("ETag", etag(user.Version))
+	ctx.JSON(http.StatusOK, user)
+}
+
+// @Summary Delete exact user
+// @Description Endpoint for deleting user with exact id. Deleted users are hidden but can be restored,
+// @Description purge removes the user permanently, deleted or not.
+// @Produce application/json
+// @Success 204 {object} UserResponseDto
+// @Failure 412 {object} map[string]string
 // @Param id path string true "id"
+// @Param purge query boolean false "remove the user permanently"
+// @Param X-Actor header string false "who performs the deletion"
+// @Param If-Match header string false "entity tag the deletion is based on"
 // @Router /users/{id} [delete]
 func (h *handler) deleteUser(ctx *gin.Context) {
 	id := ctx.Param("id")
 	h.log.Debug("got id param", slog.String("id", id))
 
-	err := h.repository.deleteUser(ctx, id)
+	versions, err := parseIfMatch(ctx.GetHeader("If-Match"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var purge bool
+	if val := ctx.Query("purge"); val != "" {
+		purge, err = strconv.ParseBool(val)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("purge must be a boolean, got %q", val),
+			})
+			return
+		}
+	}
+
+	if purge {
+		err = h.repository.purgeUser(ctx, id, httpserver.Actor(ctx), versions)
+	} else {
+		err = h.repository.deleteUser(ctx, id, httpserver.Actor(ctx), versions)
+	}
 	if err != nil {
 		logger.Error(h.log, "error during db query", err)
 		if errors.Is(err, ErrNotFound) {
 			ctx.JSON(http.StatusNotFound, gin.H{
 				"error": err.Error(),
 			})
+		} else if errors.Is(err, ErrVersionMismatch) {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error": err.Error(),
+			})
 		} else {
 			ctx.JSON(http.StatusInternalServerError, gin.H{
 				"error": err.Error(),
@@ -329,3 +840,496 @@ func (h *handler) deleteUser(ctx *gin.Context) {
 		"message": "deleted successfully",
 	})
 }
+
+// @Summary Restore exact user
+// @Description Endpoint for restoring deleted user with exact id
+// @Produce application/json
+// @Param id path string true "id"
+// @Param X-Actor header string false "who performs the restoration"
+// @Param If-Match header string false "entity tag the restoration is based on"
+// @Success 200 {object} UserResponseDto
+// @Failure 409 {object} map[string]string
+// @Failure 412 {object} map[string]string
+// @Header 200 {string} ETag "version of the restored user"
+// @Router /users/{id}/restore [post]
+func (h *handler) restoreUser(ctx *gin.Context) {
+	id := ctx.Param("id")
+	h.log.Debug("got id param", slog.String("id", id))
+
+	versions, err := parseIfMatch(ctx.GetHeader("If-Match"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = h.repository.restoreUser(ctx, id, httpserver.Actor(ctx), versions)
+	if err != nil {
+		logger.Error(h.log, "error during restoring user", err)
+		if errors.Is(err, ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+		} else if errors.Is(err, ErrNotDeleted) {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error": err.Error(),
+			})
+		} else if errors.Is(err, ErrVersionMismatch) {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	user, err := h.repository.getUser(ctx, id)
+	if err != nil {
+		logger.Error(h.log, "error during db query", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx.Header("ETag", etag(user.Version))
+	ctx.JSON(http.StatusOK, user)
+}
+
+// @Summary User history
+// @Description Endpoint for getting all versions of user with exact id, deleted and purged users included.
+// @Description Every create, update, enrichment, deletion, restoration and merge produces a version.
+// @Produce application/json
+// @Param id path string true "id"
+// @Success 200 {object} []HistoryEntryDto
+// @Router /users/{id}/history [get]
+func (h *handler) getHistory(ctx *gin.Context) {
+	id := ctx.Param("id")
+	h.log.Debug("got id param", slog.String("id", id))
+
+	history, err := h.repository.getHistory(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	ctx.JSON(http.StatusOK, history)
+}
+
+// @Summary User version
+// @Description Endpoint for getting exact version of user with exact id
+// @Produce application/json
+// @Param id path string true "id"
+// @Param version path integer true "version"
+// @Success 200 {object} HistoryEntryDto
+// @Router /users/{id}/history/{version} [get]
+func (h *handler) getHistoryEntry(ctx *gin.Context) {
+	id := ctx.Param("id")
+	h.log.Debug("got id param", slog.String("id", id))
+
+	version, err := parseVersion("version", ctx.Param("version"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	entry, ok := h.historyEntry(ctx, id, version)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, entry)
+}
+
+// @Summary Diff of user versions
+// @Description Endpoint for getting fields that changed between two versions of user with exact id
+// @Produce application/json
+// @Param id path string true "id"
+// @Param from query integer true "earlier version"
+// @Param to query integer true "later version"
+// @Success 200 {object} HistoryDiffDto
+// @Router /users/{id}/history/diff [get]
+func (h *handler) diffHistory(ctx *gin.Context) {
+	id := ctx.Param("id")
+	h.log.Debug("got id param", slog.String("id", id))
+
+	entries := make([]*HistoryEntryDto, 2)
+	for i, key := range []string{"from", "to"} {
+		version, err := parseVersion(key, ctx.Query(key))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		var ok bool
+		entries[i], ok = h.historyEntry(ctx, id, version)
+		if !ok {
+			return
+		}
+	}
+
+	diff, err := diffSnapshots(entries[0], entries[1])
+	if err != nil {
+		logger.Error(h.log, "error during comparing versions", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, diff)
+}
+
+// @Summary Revert user
+// @Description Endpoint for restoring all fields of user with exact id to a version from its history.
+// @Description The past is not rewritten, the revert is a new version. Deleted users have to be restored first.
+// @Produce application/json
+// @Param id path string true "id"
+// @Param version query integer true "version to revert to"
+// @Param X-Actor header string false "who performs the revert"
+// @Param If-Match header string false "entity tag the revert is based on"
+// @Success 200 {object} UserResponseDto
+// @Failure 412 {object} map[string]string
+// @Header 200 {string} ETag "version of the reverted user"
+// @Router /users/{id}/revert [post]
+func (h *handler) revertUser(ctx *gin.Context) {
+	id := ctx.Param("id")
+	h.log.Debug("got id param", slog.String("id", id))
+
+	version, err := parseVersion("version", ctx.Query("version"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	versions, err := parseIfMatch(ctx.GetHeader("If-Match"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = h.repository.revertUser(ctx, id, version, httpserver.Actor(ctx), versions)
+	if err != nil {
+		logger.Error(h.log, "error during reverting user", err)
+		if errors.Is(err, ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+		} else if errors.Is(err, ErrVersionMismatch) {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	user, err := h.repository.getUser(ctx, id)
+	if err != nil {
+		logger.Error(h.log, "error during db query", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	h.log.Info("user reverted", slog.String("id", id), slog.Int("version", version))
+	ctx.Header("ETag", etag(user.Version))
+	ctx.JSON(http.StatusOK, user)
+}
+
+// historyEntry loads the version of the user, failures are written to ctx.
+func (h *handler) historyEntry(ctx *gin.Context, id string, version int) (*HistoryEntryDto, bool) {
+	entry, err := h.repository.getHistoryEntry(ctx, id, version)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": fmt.Sprintf("version %d: %s", version, err.Error()),
+			})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return nil, false
+	}
+
+	return entry, true
+}
+
+func parseVersion(key, val string) (int, error) {
+	version, err := strconv.Atoi(val)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %q", key, val)
+	}
+
+	return version, nil
+}
+
+// @Summary Re-enrich user
+// @Description Endpoint for scheduling fresh enrichment of user with exact id, bypassing the enrichment cache
+// @Produce application/json
+// @Success 202 {object} jobs.Job
+// @Header 202 {string} Location "/jobs/{job_id}"
+// @Param id path string true "id"
+// @Router /users/{id}/re-enrich [post]
+func (h *handler) reEnrichUser(ctx *gin.Context) {
+	id := ctx.Param("id")
+	h.log.Debug("got id param", slog.String("id", id))
+
+	_, err := h.repository.getUser(ctx, id)
+	if err != nil {
+		logger.Error(h.log, "error during db query", err)
+		if errors.Is(err, ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	job, err := h.queue.Enqueue(ctx, JobReEnrich, id, reEnrichPayload{UserID: id, Force: true})
+	if err != nil {
+		logger.Error(h.log, "error during enqueueing job", err)
+		if errors.Is(err, jobs.ErrDuplicate) {
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	ctx.Header("Location", "/jobs/"+job.ID)
+	ctx.JSON(http.StatusAccepted, job)
+}
+
+// @Summary Merge users
+// @Description Endpoint for merging the source user into the user with exact id, the source user is deleted.
+// @Description Every field is resolved with its strategy from fields or with strategy, prefer_manual by default:
+// @Description keep_target keeps the value of the target, keep_source takes the value of the source,
+// @Description prefer_manual takes manually set values over enriched ones and fills in empty fields of the target.
+// @Description Values taken from the source keep their provenance.
+// @Accept application/json
+// @Produce application/json
+// @Param id path string true "id of the surviving user"
+// @Param X-Actor header string false "who performs the merge"
+// @Param If-Match header string false "entity tag the merge is based on"
+// @Param merge body MergeUsersDto true "source user and resolution strategies"
+// @Success 200 {object} UserResponseDto
+// @Failure 412 {object} map[string]string
+// @Header 200 {string} ETag "version of the merged user"
+// @Router /users/{id}/merge [post]
+func (h *handler) mergeUsers(ctx *gin.Context) {
+	id := ctx.Param("id")
+	h.log.Debug("got id param", slog.String("id", id))
+
+	versions, err := parseIfMatch(ctx.GetHeader("If-Match"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var dto MergeUsersDto
+	err = ctx.ShouldBindJSON(&dto)
+	if err != nil {
+		logger.Error(h.log, "error during decoding merge", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	h.log.Debug("decoded merge dto", slog.Any("dto", dto))
+
+	if dto.SourceID == "" || dto.SourceID == id {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "source_id must be set and differ from the target id",
+		})
+		return
+	}
+
+	users := make([]*UserResponseDto, 2)
+	for i, userID := range []string{id, dto.SourceID} {
+		users[i], err = h.repository.getUser(ctx, userID)
+		if err != nil {
+			logger.Error(h.log, "error during db query", err)
+			if errors.Is(err, ErrNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{
+					"error": fmt.Sprintf("user %s: %s", userID, err.Error()),
+				})
+			} else {
+				ctx.JSON(http.StatusInternalServerError, gin.H{
+					"error": err.Error(),
+				})
+			}
+			return
+		}
+	}
+	target, source := users[0], users[1]
+
+	if versions != nil && !slices.Contains(versions, target.Version) {
+		ctx.JSON(http.StatusPreconditionFailed, gin.H{
+			"error": ErrVersionMismatch.Error(),
+		})
+		return
+	}
+
+	changes, err := mergeChanges(target, source, &dto)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	h.log.Debug("resolved merge", slog.Any("changes", changes))
+
+	err = h.repository.mergeUsers(ctx, target, source, changes, httpserver.Actor(ctx))
+	if err != nil {
+		logger.Error(h.log, "error during merging users", err)
+		if errors.Is(err, ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+		} else if errors.Is(err, ErrVersionMismatch) {
+			ctx.JSON(http.StatusPreconditionFailed, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	user, err := h.repository.getUser(ctx, id)
+	if err != nil {
+		logger.Error(h.log, "error during db query", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	h.log.Info("users merged", slog.String("target", id), slog.String("source", dto.SourceID))
+	ctx.Header("ETag", etag(user.Version))
+	ctx.JSON(http.StatusOK, user)
+}
+
+// applyEnrichment copies the resolved attributes and their confidence into dto and sets its status.
+// Fields overridden manually keep their values.
+func applyEnrichment(dto *UserResponseDto, res *enrichment.Result) {
+	if dto.Enrichment == nil {
+		dto.Enrichment = &EnrichmentDto{
+			Nationalities: []NationalityDto{},
+		}
+	}
+	if dto.Provenance == nil {
+		dto.Provenance = make(map[string]ProvenanceDto)
+	}
+
+	enriched := func(field, source string) bool {
+		if isOverride(dto.Provenance[field].Source) {
+			return false
+		}
+
+		dto.Provenance[field] = ProvenanceDto{
+			Source:    source,
+			Actor:     ActorSystem,
+			UpdatedAt: time.Now(),
+		}
+		return true
+	}
+
+	if res.Key != "" {
+		dto.Enrichment.LookupKey = &res.Key
+	}
+	// the confidence of a provider only describes a value taken from it
+	if res.Age != nil && enriched(FieldAge, enrichment.ProviderAge) {
+		dto.Age = &res.Age.Age
+		dto.Enrichment.AgeCount = &res.Age.Count
+	} else if isOverride(dto.Provenance[FieldAge].Source) {
+		dto.Enrichment.AgeCount = nil
+	}
+	if res.Gender != nil && enriched(FieldGender, enrichment.ProviderGender) {
+		dto.Gender = &res.Gender.Gender
+		dto.Enrichment.GenderProbability = &res.Gender.Probability
+	} else if isOverride(dto.Provenance[FieldGender].Source) {
+		dto.Enrichment.GenderProbability = nil
+	}
+	if res.Nationality != nil {
+		countries := res.Nationality.Country
+		if len(countries) > nationalityCandidates {
+			countries = countries[:nationalityCandidates]
+		}
+
+		dto.Enrichment.Nationalities = make([]NationalityDto, len(countries))
+		for i, c := range countries {
+			dto.Enrichment.Nationalities[i] = NationalityDto{
+				CountryID:   c.CountryID,
+				Probability: c.Probability,
+			}
+		}
+
+		if enriched(FieldNationality, enrichment.ProviderNationality) {
+			dto.Nationality = &res.Nationality.Country[0].CountryID
+		}
+	}
+
+	dto.Status = StatusComplete
+	dto.FailedProviders = res.Failed
+	if !res.Complete() {
+		dto.Status = StatusPending
+	}
+}
+
+// confidenceColumns maps derived fields to the columns of the confidence their provider reported.
+var confidenceColumns = map[string]string{
+	FieldAge:    "age_count",
+	FieldGender: "gender_probability",
+}
+
+// withoutOverriddenConfidence clears the confidence of derived fields among changes whose value does not come from a provider.
+func withoutOverriddenConfidence(changes map[string]any, provenance map[string]ProvenanceDto) {
+	for field, column := range confidenceColumns {
+		if _, ok := changes[field]; ok && isOverride(provenance[field].Source) {
+			changes[column] = nil
+		}
+	}
+}
+
+func isDerivedField(field string) bool {
+	return field == FieldAge || field == FieldGender || field == FieldNationality
+}
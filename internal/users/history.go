@@ -0,0 +1,138 @@
+package users
+
+import (
+	"encoding/json"
+)
+
+// Operations recorded in the history of a user.
+const (
+	HistoryCreate  = "create"
+	HistoryUpdate  = "update"
+	HistoryEnrich  = "enrich"
+	HistoryDelete  = "delete"
+	HistoryRestore = "restore"
+	HistoryMerge   = "merge"
+	HistoryPurge   = "purge"
+	HistoryRevert  = "revert"
+)
+
+// diffSnapshots compares two snapshots field by field, unchanged fields are left out.
+func diffSnapshots(from, to *HistoryEntryDto) (*HistoryDiffDto, error) {
+	fromFields, err := snapshotFields(from.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	toFields, err := snapshotFields(to.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &HistoryDiffDto{
+		From:    from.Version,
+		To:      to.Version,
+		Changes: make(map[string]FieldChangeDto),
+	}
+	for field, val := range toFields {
+		if fromFields[field] != val {
+			diff.Changes[field] = FieldChangeDto{From: fromFields[field], To: val}
+		}
+	}
+
+	return diff, nil
+}
+
+// snapshotFields returns the JSON fields of the snapshot, all of them are strings, numbers or nulls.
+// Provenance describes the fields rather than being one, it is left out.
+func snapshotFields(snapshot *UserSnapshotDto) (map[string]any, error) {
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]any
+	err = json.Unmarshal(raw, &fields)
+	if err != nil {
+		return nil, err
+	}
+	delete(fields, "provenance")
+
+	return fields, nil
+}
+
+// revertChanges returns column changes turning the current state into the target one.
+// Deletion is not reverted, deleted users have to be restored first.
+func revertChanges(current, target *UserSnapshotDto) map[string]any {
+	changes := make(map[string]any)
+
+	if current.LastName != target.LastName {
+		changes["last_name"] = target.LastName
+	}
+	if current.FirstName != target.FirstName {
+		changes["first_name"] = target.FirstName
+	}
+	// snapshots taken before second_name was kept non-null may have it null, it means empty
+	if secondName := stringOf(target.SecondName); stringOf(current.SecondName) != secondName {
+		changes["second_name"] = secondName
+	}
+	if !equalPtr(current.Age, target.Age) {
+		changes[FieldAge] = valueOf(target.Age)
+	}
+	if !equalPtr(current.Gender, target.Gender) {
+		changes[FieldGender] = valueOf(target.Gender)
+	}
+	if !equalPtr(current.Nationality, target.Nationality) {
+		changes[FieldNationality] = valueOf(target.Nationality)
+	}
+	if current.Status != target.Status {
+		changes["enrichment_status"] = target.Status
+	}
+
+	return changes
+}
+
+// revertProvenance returns the provenance the derived fields among changes had in the target snapshot.
+// Fields without one there are returned as unknown, their current provenance no longer applies.
+func revertProvenance(changes map[string]any, target *UserSnapshotDto) (map[string]ProvenanceDto, []string) {
+	provenance := make(map[string]ProvenanceDto)
+	var unknown []string
+	for field := range changes {
+		if !isDerivedField(field) {
+			continue
+		}
+
+		if p, ok := target.Provenance[field]; ok {
+			provenance[field] = p
+		} else {
+			unknown = append(unknown, field)
+		}
+	}
+
+	return provenance, unknown
+}
+
+// valueOf dereferences p, nil stays an untyped nil so that the column is cleared.
+func valueOf[T any](p *T) any {
+	if p == nil {
+		return nil
+	}
+
+	return *p
+}
+
+// stringOf dereferences p, nil is an empty string.
+func stringOf(p *string) string {
+	if p == nil {
+		return ""
+	}
+
+	return *p
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
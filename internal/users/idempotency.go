@@ -0,0 +1,219 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/httpserver"
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on stored responses sent again.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+const (
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBody       = 1 << 20
+	// idempotencyLease is how long a request holds its key, keys of crashed requests can be taken over after it.
+	// It has to outlast enrichment of a user.
+	idempotencyLease = time.Minute
+	// idempotencyWait is how long a retry waits for the response of the request in progress before 409.
+	idempotencyWait         = 5 * time.Second
+	idempotencyPollInterval = 100 * time.Millisecond
+)
+
+var (
+	// errIdempotencyMismatch is returned when a key is used again for a different request.
+	errIdempotencyMismatch = errors.New("idempotency key was used for a different request")
+	// errIdempotencyInProgress is returned when the request holding a key does not finish in time.
+	errIdempotencyInProgress = errors.New("request with the same idempotency key is in progress")
+)
+
+// idempotentHeaders are the response headers stored with the response.
+var idempotentHeaders = []string{"Content-Type", "Location", "Preference-Applied", "ETag"}
+
+type idempotencyConfig struct {
+	ttl time.Duration
+}
+
+// NewIdempotencyConfig configures Idempotency-Key handling, responses are replayed for ttl after the first request.
+func NewIdempotencyConfig(ttl time.Duration) *idempotencyConfig {
+	return &idempotencyConfig{
+		ttl: ttl,
+	}
+}
+
+// idempotentRequest is a request made with an idempotency key, status is 0 while it is in progress.
+type idempotentRequest struct {
+	hash    string
+	status  int
+	headers map[string]string
+	body    []byte
+}
+
+// responseRecorder keeps a copy of the response body.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent sends retries of a request with the same Idempotency-Key the response of the first one.
+// A retry arriving while the first request is in progress waits for it, then gets 409. Server errors
+// are not stored, so requests that failed that way can be retried with the same key.
+func (h *handler) idempotent(ctx *gin.Context) {
+	key := ctx.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		ctx.Next()
+		return
+	}
+
+	if len(key) > maxIdempotencyKeyLength {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("%s must not be longer than %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength),
+		})
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxIdempotentBody))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	hash := requestHash(ctx, body)
+
+	stored, err := h.claimIdempotencyKey(ctx, key, hash)
+	if err != nil {
+		logger.Error(h.log, "error during claiming idempotency key", err)
+		if errors.Is(err, errIdempotencyMismatch) {
+			ctx.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": err.Error(),
+			})
+		} else if errors.Is(err, errIdempotencyInProgress) {
+			ctx.Header("Retry-After", "1")
+			ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": err.Error(),
+			})
+		} else {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	if stored != nil {
+		for name, val := range stored.headers {
+			ctx.Header(name, val)
+		}
+		ctx.Header(IdempotentReplayedHeader, "true")
+		ctx.Data(stored.status, stored.headers["Content-Type"], stored.body)
+		ctx.Abort()
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: ctx.Writer}
+	ctx.Writer = recorder
+	ctx.Next()
+
+	// the response is stored even if the client is gone, its retry is going to ask for it
+	saveCtx := context.WithoutCancel(ctx.Request.Context())
+
+	if recorder.Status() >= http.StatusInternalServerError {
+		err = h.repository.releaseIdempotencyKey(saveCtx, key, hash)
+		if err != nil {
+			logger.Error(h.log, "error during releasing idempotency key", err)
+		}
+		return
+	}
+
+	res := &idempotentRequest{
+		hash:    hash,
+		status:  recorder.Status(),
+		headers: make(map[string]string),
+		body:    recorder.body.Bytes(),
+	}
+	for _, name := range idempotentHeaders {
+		if val := recorder.Header().Get(name); val != "" {
+			res.headers[name] = val
+		}
+	}
+
+	err = h.repository.saveIdempotentResponse(saveCtx, key, res)
+	if err != nil {
+		logger.Error(h.log, "error during saving idempotent response", err)
+	}
+}
+
+// claimIdempotencyKey locks the key for the request, if the key was already used for it the stored request
+// is returned instead. A request in progress is waited for up to idempotencyWait.
+func (h *handler) claimIdempotencyKey(ctx context.Context, key, hash string) (*idempotentRequest, error) {
+	deadline := time.Now().Add(idempotencyWait)
+
+	for {
+		claimed, err := h.repository.claimIdempotencyKey(ctx, key, hash, idempotencyLease, h.idempotency.ttl)
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return nil, nil
+		}
+
+		stored, err := h.repository.getIdempotencyKey(ctx, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if stored != nil {
+			if stored.hash != hash {
+				return nil, errIdempotencyMismatch
+			}
+			if stored.status != 0 {
+				return stored, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errIdempotencyInProgress
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+}
+
+// requestHash identifies a request by its actor, method, URL, preferences and body.
+func requestHash(ctx *gin.Context, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s %s\n%s\n", httpserver.Actor(ctx), ctx.Request.Method, ctx.Request.URL.RequestURI(), ctx.GetHeader("Prefer"))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,472 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/enrichment"
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+)
+
+// Formats of user imports.
+const (
+	ImportCSV    = "csv"
+	ImportNDJSON = "ndjson"
+)
+
+const (
+	importBatchSize   = 500
+	importConcurrency = 8
+	// maxImportSize limits uploads, imports larger than maxSyncImportSize run as jobs.
+	maxImportSize     = 32 << 20
+	maxSyncImportSize = 1 << 20
+	maxNDJSONLine     = 64 << 10
+	// importChunkSize is the size of the chunks uploads of import jobs are stored in.
+	importChunkSize = 1 << 20
+)
+
+// importColumns are the columns of CSV imports, all but last_name and first_name are optional.
+var importColumns = []string{"last_name", "first_name", "second_name", FieldAge, FieldGender, FieldNationality}
+
+// importFormat takes the format from the format query parameter or the content type.
+func importFormat(format, contentType string) (string, error) {
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		switch mediaType {
+		case "text/csv":
+			format = ImportCSV
+		case "application/x-ndjson", "application/jsonl":
+			format = ImportNDJSON
+		}
+	}
+
+	switch format {
+	case ImportCSV, ImportNDJSON:
+		return format, nil
+	case "":
+		return "", fmt.Errorf("content type must be text/csv or application/x-ndjson")
+	default:
+		return "", fmt.Errorf("format must be %s or %s, got %q", ImportCSV, ImportNDJSON, format)
+	}
+}
+
+type importRow struct {
+	line int
+	dto  ImportUserDto
+	err  error
+}
+
+// rowReader returns rows one by one, io.EOF ends the import. Errors of single rows are
+// returned in importRow.err, other errors abort the import.
+type rowReader func() (*importRow, error)
+
+func newRowReader(r io.Reader, format string) (rowReader, error) {
+	if format == ImportCSV {
+		return newCSVReader(r)
+	}
+
+	return newNDJSONReader(r), nil
+}
+
+func newCSVReader(r io.Reader) (rowReader, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("csv header is missing")
+		}
+		return nil, err
+	}
+
+	positions := make(map[string]int, len(header))
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		if !slices.Contains(importColumns, column) {
+			return nil, fmt.Errorf("unknown csv column %q", column)
+		}
+		positions[column] = i
+	}
+	for _, column := range []string{"last_name", "first_name"} {
+		if _, ok := positions[column]; !ok {
+			return nil, fmt.Errorf("csv column %q is missing", column)
+		}
+	}
+
+	return func() (*importRow, error) {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return &importRow{line: parseErr.StartLine, err: parseErr.Err}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := &importRow{line: line}
+
+		field := func(column string) string {
+			if i, ok := positions[column]; ok {
+				return record[i]
+			}
+			return ""
+		}
+		// empty cells of optional columns are left out
+		optional := func(column string) *string {
+			if val := strings.TrimSpace(field(column)); val != "" {
+				return &val
+			}
+			return nil
+		}
+		row.dto = ImportUserDto{
+			LastName:    field("last_name"),
+			FirstName:   field("first_name"),
+			SecondName:  field("second_name"),
+			Gender:      optional(FieldGender),
+			Nationality: optional(FieldNationality),
+		}
+
+		if age := optional(FieldAge); age != nil {
+			val, err := strconv.Atoi(*age)
+			if err != nil {
+				row.err = fmt.Errorf("age must be a number, got %q", *age)
+				return row, nil
+			}
+			row.dto.Age = &val
+		}
+
+		return row, nil
+	}, nil
+}
+
+func newNDJSONReader(r io.Reader) rowReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxNDJSONLine)
+
+	var line int
+	return func() (*importRow, error) {
+		for scanner.Scan() {
+			line++
+
+			raw := bytes.TrimSpace(scanner.Bytes())
+			if len(raw) == 0 {
+				continue
+			}
+
+			row := &importRow{line: line}
+
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			row.err = decoder.Decode(&row.dto)
+
+			return row, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+		return nil, io.EOF
+	}
+}
+
+// importer creates users from rows in batches, enrichment runs concurrently within a batch.
+type importer struct {
+	log        *slog.Logger
+	repository storage
+	enricher   enrichment.Enricher
+}
+
+func newImporter(logger *slog.Logger, repo storage, enricher enrichment.Enricher) *importer {
+	return &importer{
+		log:        logger,
+		repository: repo,
+		enricher:   enricher,
+	}
+}
+
+// run imports all rows, progress is called with the counters after every batch.
+// Rows that can not be saved are reported as failed, the import goes on. If the upload
+// can not be read to the end, the report of the rows before is returned with the error.
+func (i *importer) run(ctx context.Context, next rowReader, actor string, progress func(*ImportReportDto)) (*ImportReportDto, error) {
+	report := &ImportReportDto{
+		Rows: []ImportRowDto{},
+	}
+
+	err := i.importRows(ctx, next, actor, report, progress, func(users []*UserResponseDto, rows []ImportRowDto) error {
+		ids, err := i.repository.saveUsers(ctx, users, actor)
+		setImportedRows(rows, users, ids, err)
+		return nil
+	})
+
+	return report, err
+}
+
+// resume runs an import stored by saveImport. Every batch is recorded together with its users,
+// so an import run again after a crash or a lost lease skips the rows of the recorded batches.
+// An error is only returned if a batch can not be saved, the job is retried then. The upload
+// is not read again if it is broken, the error is in the report.
+func (i *importer) resume(ctx context.Context, id string, upload *userImport, progress func(*ImportReportDto)) (*ImportReportDto, error) {
+	done, batches, err := i.repository.getImportRows(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReportDto{
+		Rows: []ImportRowDto{},
+	}
+	report.add(done)
+
+	next, err := newRowReader(upload.data, upload.format)
+	if err != nil {
+		return nil, err
+	}
+
+	for skipped := 0; skipped < report.Total; skipped++ {
+		_, err = next()
+		if err != nil {
+			return nil, fmt.Errorf("skipping imported rows: %w", err)
+		}
+	}
+	if report.Total != 0 {
+		i.log.Info("import resumed", slog.String("import", id), slog.Int("rows", report.Total))
+	}
+
+	var saveErr error
+	_ = i.importRows(ctx, next, upload.actor, report, progress, func(users []*UserResponseDto, rows []ImportRowDto) error {
+		batches++
+		saveErr = i.repository.saveImportBatch(ctx, id, batches, users, rows, upload.actor)
+		return saveErr
+	})
+	if saveErr != nil {
+		return nil, saveErr
+	}
+
+	return report, nil
+}
+
+// importRows imports the rows in batches with save and adds them to report. An error of save stops
+// the import, the batch is not added then. Errors of reading the upload are set in the report too.
+func (i *importer) importRows(ctx context.Context, next rowReader, actor string, report *ImportReportDto, progress func(*ImportReportDto), save func([]*UserResponseDto, []ImportRowDto) error) error {
+	for {
+		batch, readErr := readBatch(next, importBatchSize)
+		if len(batch) != 0 {
+			users, rows := i.prepareBatch(ctx, batch, actor)
+
+			err := save(users, rows)
+			if err != nil {
+				return err
+			}
+			report.add(rows)
+
+			i.log.Info("import batch saved", slog.Int("rows", len(batch)), slog.Int("users", len(users)))
+		}
+		if readErr != nil {
+			report.Error = readErr.Error()
+			return readErr
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if progress != nil {
+			progress(&ImportReportDto{
+				Total:   report.Total,
+				Created: report.Created,
+				Failed:  report.Failed,
+			})
+		}
+	}
+}
+
+// readBatch reads up to size rows, the rows read before an error are returned with it.
+func readBatch(next rowReader, size int) ([]*importRow, error) {
+	batch := make([]*importRow, 0, size)
+	for len(batch) < size {
+		row, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return batch, err
+		}
+
+		batch = append(batch, row)
+	}
+
+	return batch, nil
+}
+
+// prepareBatch validates and enriches the rows of a batch. It returns the users to save and
+// the outcomes of all rows, the rows without an error belong to the users in order.
+func (i *importer) prepareBatch(ctx context.Context, batch []*importRow, actor string) ([]*UserResponseDto, []ImportRowDto) {
+	rows := make([]ImportRowDto, len(batch))
+	users := make([]*UserResponseDto, 0, len(batch))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, importConcurrency)
+	for n, row := range batch {
+		rows[n].Row = row.line
+
+		if row.err == nil {
+			row.err = validateImportRow(&row.dto)
+		}
+		if row.err != nil {
+			rows[n].Error = row.err.Error()
+			continue
+		}
+
+		user := importedUser(&row.dto, actor)
+		users = append(users, user)
+
+		// only the providers of the fields the row does not give are asked
+		providers := missingProviders(user)
+		if len(providers) == 0 {
+			applyEnrichment(user, &enrichment.Result{})
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			enriched, err := i.enricher.Enrich(enrichment.WithProviders(ctx, providers...), user.FirstName)
+			if err != nil {
+				logger.Error(i.log, "enrichment failed, imported user will be saved as pending", err)
+			}
+			applyEnrichment(user, enriched)
+		}()
+	}
+	wg.Wait()
+
+	return users, rows
+}
+
+// setImportedRows sets the ids and statuses of the saved users in the rows they come from,
+// if saving failed the rows get the error instead.
+func setImportedRows(rows []ImportRowDto, users []*UserResponseDto, ids []string, err error) {
+	var saved int
+	for n := range rows {
+		if rows[n].Error != "" {
+			continue
+		}
+
+		if err != nil {
+			rows[n].Error = err.Error()
+			continue
+		}
+
+		rows[n].ID = ids[saved]
+		rows[n].Status = users[saved].Status
+		saved++
+	}
+}
+
+// add counts the rows and appends them to the report.
+func (r *ImportReportDto) add(rows []ImportRowDto) {
+	for _, row := range rows {
+		r.Total++
+		if row.Error != "" {
+			r.Failed++
+		} else {
+			r.Created++
+		}
+	}
+	r.Rows = append(r.Rows, rows...)
+}
+
+// importedUser makes a user of the row, the derived fields it gives are recorded as imported by actor.
+func importedUser(dto *ImportUserDto, actor string) *UserResponseDto {
+	user := &UserResponseDto{
+		LastName:    strings.TrimSpace(dto.LastName),
+		FirstName:   strings.TrimSpace(dto.FirstName),
+		SecondName:  strings.TrimSpace(dto.SecondName),
+		Age:         dto.Age,
+		Gender:      dto.Gender,
+		Nationality: dto.Nationality,
+		Provenance:  make(map[string]ProvenanceDto),
+	}
+
+	imported := map[string]bool{
+		FieldAge:         dto.Age != nil,
+		FieldGender:      dto.Gender != nil,
+		FieldNationality: dto.Nationality != nil,
+	}
+	for field, ok := range imported {
+		if ok {
+			user.Provenance[field] = ProvenanceDto{
+				Source:    SourceImport,
+				Actor:     actor,
+				UpdatedAt: time.Now(),
+			}
+		}
+	}
+
+	return user
+}
+
+// missingProviders returns the providers of the derived fields the user does not have yet.
+func missingProviders(user *UserResponseDto) []string {
+	var providers []string
+	if user.Age == nil {
+		providers = append(providers, enrichment.ProviderAge)
+	}
+	if user.Gender == nil {
+		providers = append(providers, enrichment.ProviderGender)
+	}
+	if user.Nationality == nil {
+		providers = append(providers, enrichment.ProviderNationality)
+	}
+
+	return providers
+}
+
+func validateImportRow(dto *ImportUserDto) error {
+	if err := validateName("last_name", dto.LastName); err != nil {
+		return err
+	}
+	if err := validateName("first_name", dto.FirstName); err != nil {
+		return err
+	}
+
+	if dto.Age != nil {
+		if err := validateAge(*dto.Age); err != nil {
+			return err
+		}
+	}
+	if dto.Gender != nil {
+		if err := validateGender(*dto.Gender); err != nil {
+			return err
+		}
+	}
+	if dto.Nationality != nil {
+		if err := validateNationality(*dto.Nationality); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/enrichment"
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/httpserver"
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/jobs"
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+)
+
+const (
+	JobReEnrich = "users.re_enrich"
+	JobImport   = "users.import"
+	JobCreate   = "users.create"
+)
+
+// Stages of users created with Prefer: respond-async.
+const (
+	CreateQueued    = "queued"
+	CreateEnriching = "enriching"
+	CreateDone      = "done"
+	CreateFailed    = "failed"
+)
+
+type reEnrichPayload struct {
+	UserID string `json:"user_id"`
+	// Force bypasses the enrichment cache.
+	Force bool `json:"force,omitempty"`
+}
+
+// reEnricher runs enrichment again for a single user.
+type reEnricher struct {
+	log        *slog.Logger
+	repository storage
+	enricher   enrichment.Enricher
+}
+
+func newReEnricher(logger *slog.Logger, repo storage, enricher enrichment.Enricher) *reEnricher {
+	return &reEnricher{
+		log:        logger,
+		repository: repo,
+		enricher:   enricher,
+	}
+}
+
+func (r *reEnricher) process(ctx context.Context, raw json.RawMessage) (any, error) {
+	var payload reEnrichPayload
+	err := json.Unmarshal(raw, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := r.repository.getUser(ctx, payload.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	enrichCtx := ctx
+	if payload.Force || user.Status != StatusPending {
+		enrichCtx = enrichment.WithoutCache(ctx)
+	}
+
+	res, err := r.enricher.Enrich(enrichCtx, user.FirstName)
+	if err != nil {
+		logger.Error(r.log, "re-enrichment is incomplete", err)
+	}
+	applyEnrichment(user, res)
+
+	err = r.repository.saveEnrichment(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	r.log.Info("user re-enriched", slog.String("id", user.ID), slog.String("status", user.Status))
+
+	return user, nil
+}
+
+type importPayload struct {
+	ImportID string `json:"import_id"`
+}
+
+// importJob runs an uploaded import, the upload is removed once it is done.
+// A job claimed again continues after the last saved batch.
+type importJob struct {
+	log        *slog.Logger
+	repository storage
+	importer   *importer
+}
+
+func newImportJob(logger *slog.Logger, repo storage, importer *importer) *importJob {
+	return &importJob{
+		log:        logger,
+		repository: repo,
+		importer:   importer,
+	}
+}
+
+func (j *importJob) process(ctx context.Context, raw json.RawMessage) (any, error) {
+	var payload importPayload
+	err := json.Unmarshal(raw, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	upload, err := j.repository.getImport(ctx, payload.ImportID)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := j.importer.resume(ctx, payload.ImportID, upload, func(progress *ImportReportDto) {
+		err := jobs.ReportProgress(ctx, progress)
+		if err != nil {
+			logger.Error(j.log, "error during reporting import progress", err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// a broken upload is not retried, the rows before the error are already imported
+	if report.Error != "" {
+		logger.Error(j.log, "import stopped early", errors.New(report.Error))
+	}
+
+	err = j.repository.deleteImport(ctx, payload.ImportID)
+	if err != nil {
+		logger.Error(j.log, "error during deleting import upload", err)
+	}
+	j.log.Info("users imported", slog.String("import", payload.ImportID), slog.Int("created", report.Created), slog.Int("failed", report.Failed))
+
+	return report, nil
+}
+
+// createPayload is a create request accepted with Prefer: respond-async,
+// duplicates are looked up before the request is accepted.
+type createPayload struct {
+	User       UserRequestDto `json:"user"`
+	Duplicates []string       `json:"duplicates,omitempty"`
+	Actor      string         `json:"actor"`
+	RequestID  string         `json:"request_id,omitempty"`
+}
+
+// createJob enriches and saves a user created asynchronously.
+type createJob struct {
+	log           *slog.Logger
+	repository    storage
+	enricher      enrichment.Enricher
+	quotaFallback string
+}
+
+func newCreateJob(logger *slog.Logger, repo storage, enricher enrichment.Enricher, quotaFallback string) *createJob {
+	return &createJob{
+		log:           logger,
+		repository:    repo,
+		enricher:      enricher,
+		quotaFallback: quotaFallback,
+	}
+}
+
+func (j *createJob) process(ctx context.Context, raw json.RawMessage) (any, error) {
+	var payload createPayload
+	err := json.Unmarshal(raw, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// the history of the user refers to the request that asked for it
+	ctx = httpserver.WithRequestID(ctx, payload.RequestID)
+
+	// a previous attempt may have saved the user and failed afterwards, e.g. when its lease was lost
+	id, err := j.repository.getCreatedUser(ctx, jobs.ID(ctx))
+	if err == nil {
+		user, err := j.repository.getUser(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		user.PossibleDuplicates = payload.Duplicates
+		j.log.Info("user already created", slog.String("id", user.ID))
+
+		return user, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	user := &UserResponseDto{
+		LastName:           payload.User.LastName,
+		FirstName:          payload.User.FirstName,
+		SecondName:         payload.User.SecondName,
+		PossibleDuplicates: payload.Duplicates,
+	}
+
+	res, err := j.enricher.Enrich(ctx, user.FirstName)
+	if err != nil {
+		// rejected like a synchronous create, retrying before the reset is rejected again
+		if quotaErr, ok := quotaRejection(j.quotaFallback, err); ok {
+			return nil, jobs.Permanent(quotaErr)
+		}
+		logger.Error(j.log, "enrichment failed, user will be saved as pending", err)
+	}
+	applyEnrichment(user, res)
+
+	user.ID, err = j.repository.saveUser(ctx, user, payload.Actor)
+	if err != nil {
+		return nil, err
+	}
+	j.log.Info("user created", slog.String("id", user.ID), slog.String("status", user.Status))
+
+	return user, nil
+}
+
+// newCreateJobDto describes a create job, a running job is enriching the user.
+// A job waiting for a retry is queued again.
+func newCreateJobDto(job *jobs.Job) (*CreateJobDto, error) {
+	dto := &CreateJobDto{
+		ID:        job.ID,
+		Attempts:  job.Attempts,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+
+	switch job.Status {
+	case jobs.StatusRunning:
+		dto.Status = CreateEnriching
+	case jobs.StatusDone:
+		dto.Status = CreateDone
+	case jobs.StatusFailed:
+		dto.Status = CreateFailed
+	default:
+		dto.Status = CreateQueued
+	}
+
+	if len(job.Result) != 0 && job.Status == jobs.StatusDone {
+		err := json.Unmarshal(job.Result, &dto.User)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dto, nil
+}
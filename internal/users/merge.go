@@ -0,0 +1,107 @@
+package users
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Strategies of resolving a field when merging two users.
+const (
+	MergeKeepTarget   = "keep_target"
+	MergeKeepSource   = "keep_source"
+	MergePreferManual = "prefer_manual"
+)
+
+// mergeFields are the fields a merge can take from the source user.
+var mergeFields = []string{"last_name", "first_name", "second_name", FieldAge, FieldGender, FieldNationality}
+
+// mergeChanges resolves every field of the merge and returns the changes of target.
+// prefer_manual takes a derived field of source only if it was set manually and the one of target was not,
+// empty fields of target are filled in from source.
+func mergeChanges(target, source *UserResponseDto, dto *MergeUsersDto) (map[string]any, error) {
+	strategy := dto.Strategy
+	if strategy == "" {
+		strategy = MergePreferManual
+	}
+	if err := validateMergeStrategy("strategy", strategy); err != nil {
+		return nil, err
+	}
+
+	for field, s := range dto.Fields {
+		if !slices.Contains(mergeFields, field) {
+			return nil, fmt.Errorf("field %q can not be merged", field)
+		}
+		if err := validateMergeStrategy(field, s); err != nil {
+			return nil, err
+		}
+	}
+
+	targetValues, sourceValues := mergeValues(target), mergeValues(source)
+
+	changes := make(map[string]any)
+	for _, field := range mergeFields {
+		s, ok := dto.Fields[field]
+		if !ok {
+			s = strategy
+		}
+
+		var takeSource bool
+		switch s {
+		case MergeKeepSource:
+			takeSource = true
+		case MergePreferManual:
+			takeSource = targetValues[field] == nil ||
+				isOverride(source.Provenance[field].Source) && !isOverride(target.Provenance[field].Source)
+		}
+
+		if takeSource && sourceValues[field] != nil && sourceValues[field] != targetValues[field] {
+			changes[field] = sourceValues[field]
+		}
+	}
+
+	return changes, nil
+}
+
+// mergeProvenance keeps the provenance of derived fields taken from source, fields of source
+// without provenance are recorded as set manually by actor.
+func mergeProvenance(changes map[string]any, source *UserResponseDto, actor string) map[string]ProvenanceDto {
+	provenance := manualProvenance(changes, actor)
+	for field := range provenance {
+		if p, ok := source.Provenance[field]; ok {
+			provenance[field] = p
+		}
+	}
+
+	return provenance
+}
+
+// mergeValues returns the mergeable fields of dto, unset ones are nil.
+func mergeValues(dto *UserResponseDto) map[string]any {
+	values := map[string]any{
+		"last_name":  dto.LastName,
+		"first_name": dto.FirstName,
+	}
+	if dto.SecondName != "" {
+		values["second_name"] = dto.SecondName
+	}
+	if dto.Age != nil {
+		values[FieldAge] = *dto.Age
+	}
+	if dto.Gender != nil {
+		values[FieldGender] = *dto.Gender
+	}
+	if dto.Nationality != nil {
+		values[FieldNationality] = *dto.Nationality
+	}
+
+	return values
+}
+
+func validateMergeStrategy(field, strategy string) error {
+	switch strategy {
+	case MergeKeepTarget, MergeKeepSource, MergePreferManual:
+		return nil
+	default:
+		return fmt.Errorf("%s must be %s, %s or %s, got %q", field, MergeKeepTarget, MergeKeepSource, MergePreferManual, strategy)
+	}
+}
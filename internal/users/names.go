@@ -0,0 +1,46 @@
+package users
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/names"
+)
+
+// withNameKeys adds transliterated and phonetic keys of the changed name columns,
+// they are stored next to the names for search and duplicate detection.
+func withNameKeys(changes map[string]any) map[string]any {
+	res := make(map[string]any, len(changes))
+	for col, val := range changes {
+		res[col] = val
+
+		if !slices.Contains(nameColumns, col) {
+			continue
+		}
+
+		name, ok := val.(string)
+		if !ok {
+			res[col+"_translit"] = nil
+			res[col+"_phonetic"] = nil
+			continue
+		}
+
+		res[col+"_translit"] = names.Translit(name)
+		res[col+"_phonetic"] = names.Phonetic(name)
+	}
+
+	return res
+}
+
+// phoneticKeys returns distinct phonetic keys of the words of q.
+func phoneticKeys(q string) []string {
+	var keys []string
+	for _, word := range strings.Fields(q) {
+		key := names.Phonetic(word)
+		if key != "" && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,155 @@
+package users
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+)
+
+// cursor points at the boundary row of a page. It is opaque for clients.
+type cursor struct {
+	Sort     string    `json:"s"`
+	Values   []*string `json:"v"`
+	Backward bool      `json:"b,omitempty"`
+}
+
+type pageRequest struct {
+	order  sortOrder
+	limit  int
+	cursor *cursor
+	total  bool
+}
+
+func parsePageRequest(ctx *gin.Context) (*pageRequest, error) {
+	order, err := parseSort(ctx.Query("sort"))
+	if err != nil {
+		return nil, err
+	}
+
+	page := &pageRequest{
+		order: order,
+		limit: defaultLimit,
+	}
+
+	if val := ctx.Query("limit"); val != "" {
+		page.limit, err = strconv.Atoi(val)
+		if err != nil || page.limit < 1 || page.limit > maxLimit {
+			return nil, fmt.Errorf("limit must be an integer between 1 and %d, got %q", maxLimit, val)
+		}
+	}
+
+	if val := ctx.Query("cursor"); val != "" {
+		page.cursor, err = decodeCursor(val)
+		if err != nil || page.cursor.Sort != order.String() || len(page.cursor.Values) != len(order) {
+			return nil, fmt.Errorf("invalid cursor for sort %q", ctx.Query("sort"))
+		}
+	}
+
+	if val := ctx.Query("total"); val != "" {
+		page.total, err = strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("total must be a boolean, got %q", val)
+		}
+	}
+
+	return page, nil
+}
+
+// queryOrder is the order rows have to be fetched in, backward pages are fetched reversed.
+func (p *pageRequest) queryOrder() sortOrder {
+	if p.cursor != nil && p.cursor.Backward {
+		return p.order.reversed()
+	}
+
+	return p.order
+}
+
+// newUsersPage builds the envelope from rows fetched in queryOrder with one extra row,
+// which tells whether there is a page beyond.
+func newUsersPage(rows []*UserResponseDto, page *pageRequest) *UsersPageDto {
+	more := len(rows) > page.limit
+	if more {
+		rows = rows[:page.limit]
+	}
+
+	backward := page.cursor != nil && page.cursor.Backward
+	if backward {
+		slices.Reverse(rows)
+	}
+
+	res := &UsersPageDto{
+		Data: rows,
+	}
+	if res.Data == nil {
+		res.Data = []*UserResponseDto{}
+	}
+
+	if len(rows) == 0 {
+		return res
+	}
+
+	if more || backward {
+		res.NextCursor = page.encodeCursor(rows[len(rows)-1], false)
+	}
+	if (more && backward) || (!backward && page.cursor != nil) {
+		res.PrevCursor = page.encodeCursor(rows[0], true)
+	}
+
+	return res
+}
+
+func (p *pageRequest) encodeCursor(dto *UserResponseDto, backward bool) string {
+	bytes, _ := json.Marshal(cursor{
+		Sort:     p.order.String(),
+		Values:   p.order.values(dto),
+		Backward: backward,
+	})
+
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func decodeCursor(val string) (*cursor, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return nil, err
+	}
+
+	var c cursor
+	err = json.Unmarshal(bytes, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// linkHeader renders RFC 8288 links to the neighbouring pages of the request URL.
+func linkHeader(u *url.URL, page *UsersPageDto) string {
+	var links []string
+
+	for _, l := range []struct{ rel, cursor string }{
+		{"next", page.NextCursor},
+		{"prev", page.PrevCursor},
+	} {
+		if l.cursor == "" {
+			continue
+		}
+
+		q := u.Query()
+		q.Set("cursor", l.cursor)
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, q.Encode(), l.rel))
+	}
+
+	return strings.Join(links, ", ")
+}
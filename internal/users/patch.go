@@ -0,0 +1,84 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// decodeMergePatch turns a merge patch document into column changes, nil values clear the column.
+func decodeMergePatch(body []byte) (map[string]any, error) {
+	var members map[string]json.RawMessage
+	err := json.Unmarshal(body, &members)
+	if err != nil || members == nil {
+		return nil, fmt.Errorf("merge patch must be a JSON object")
+	}
+
+	var dto UpdateUserDto
+	err = json.Unmarshal(body, &dto)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]any, len(members))
+	for field, raw := range members {
+		isNull := bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+
+		switch field {
+		case "last_name":
+			if isNull {
+				return nil, fmt.Errorf("last_name can not be cleared")
+			}
+			if err = validateName(field, *dto.LastName); err != nil {
+				return nil, err
+			}
+			changes[field] = *dto.LastName
+		case "first_name":
+			if isNull {
+				return nil, fmt.Errorf("first_name can not be cleared")
+			}
+			if err = validateName(field, *dto.FirstName); err != nil {
+				return nil, err
+			}
+			changes[field] = *dto.FirstName
+		case "second_name":
+			// users without a second name have an empty one, as on create
+			if isNull {
+				changes[field] = ""
+				continue
+			}
+			changes[field] = *dto.SecondName
+		case FieldAge:
+			if isNull {
+				changes[field] = nil
+				continue
+			}
+			if err = validateAge(*dto.Age); err != nil {
+				return nil, err
+			}
+			changes[field] = *dto.Age
+		case FieldGender:
+			if isNull {
+				changes[field] = nil
+				continue
+			}
+			if err = validateGender(*dto.Gender); err != nil {
+				return nil, err
+			}
+			changes[field] = *dto.Gender
+		case FieldNationality:
+			if isNull {
+				changes[field] = nil
+				continue
+			}
+			if err = validateNationality(*dto.Nationality); err != nil {
+				return nil, err
+			}
+			changes[field] = *dto.Nationality
+		default:
+			return nil, fmt.Errorf("field %q can not be updated", field)
+		}
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,50 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/enrichment"
+)
+
+// Behaviors of user creation while the quota of an enrichment provider is exhausted.
+const (
+	// QuotaFallbackPending saves users as pending_enrichment, the scheduler enriches them after the reset.
+	QuotaFallbackPending = "pending"
+	// QuotaFallbackReject responds 503 with Retry-After until the reset, nothing is saved.
+	QuotaFallbackReject = "reject"
+)
+
+// ParseQuotaFallback returns the fallback with the given name, empty name gives QuotaFallbackPending.
+func ParseQuotaFallback(name string) (string, error) {
+	switch name {
+	case "", QuotaFallbackPending:
+		return QuotaFallbackPending, nil
+	case QuotaFallbackReject:
+		return QuotaFallbackReject, nil
+	default:
+		return "", fmt.Errorf("quota fallback must be %s or %s, got %q", QuotaFallbackPending, QuotaFallbackReject, name)
+	}
+}
+
+// quotaRejection returns the quota error of an enrichment error if the fallback rejects creates because of it.
+func quotaRejection(fallback string, err error) (*enrichment.QuotaError, bool) {
+	var quotaErr *enrichment.QuotaError
+	if fallback != QuotaFallbackReject || !errors.As(err, &quotaErr) {
+		return nil, false
+	}
+
+	return quotaErr, true
+}
+
+// retryAfter is the Retry-After value in seconds for the given time, at least 1.
+func retryAfter(at time.Time) string {
+	seconds := int(time.Until(at).Seconds()) + 1
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return strconv.Itoa(seconds)
+}
@@ -4,17 +4,31 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/httpserver"
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/jobs"
 	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/names"
 	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/postgresql"
 )
 
-var ErrNotFound = errors.New("not found")
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrVersionMismatch is returned when the user was changed since the version the client has seen.
+	ErrVersionMismatch = errors.New("user version does not match")
+	// ErrNotDeleted is returned when restoring a user that is not deleted.
+	ErrNotDeleted = errors.New("user is not deleted")
+)
 
 type repository struct {
 	log  *slog.Logger
@@ -28,16 +42,51 @@ func newRepository(logger *slog.Logger, pool *pgxpool.Pool) storage {
 	}
 }
 
-func (r *repository) saveUser(ctx context.Context, dto *UserResponseDto) (string, error) {
+func (r *repository) saveUser(ctx context.Context, dto *UserResponseDto, actor string) (string, error) {
 	query := `
-		INSERT INTO users (last_name, first_name, second_name, age, gender, nationality)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO users (
+			last_name, first_name, second_name, age, gender, nationality, enrichment_status, age_count, gender_probability, enrichment_key, enriched_at,
+			last_name_translit, first_name_translit, second_name_translit, last_name_phonetic, first_name_phonetic, second_name_phonetic
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, now(), $11, $12, $13, $14, $15, $16)
 		RETURNING id
 	`
 
+	keys := withNameKeys(map[string]any{
+		"last_name":   dto.LastName,
+		"first_name":  dto.FirstName,
+		"second_name": dto.SecondName,
+	})
+
 	var id string
-	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
-	err := r.pool.QueryRow(ctx, query, dto.LastName, dto.FirstName, dto.SecondName, dto.Age, dto.Gender, dto.Nationality).Scan(&id)
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+		err := tx.QueryRow(ctx, query,
+			dto.LastName, dto.FirstName, dto.SecondName, dto.Age, dto.Gender, dto.Nationality, dto.Status, dto.Enrichment.AgeCount, dto.Enrichment.GenderProbability, dto.Enrichment.LookupKey,
+			keys["last_name_translit"], keys["first_name_translit"], keys["second_name_translit"],
+			keys["last_name_phonetic"], keys["first_name_phonetic"], keys["second_name_phonetic"],
+		).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		err = r.saveNationalities(ctx, tx, id, dto.Enrichment.Nationalities)
+		if err != nil {
+			return err
+		}
+
+		err = r.saveProvenance(ctx, tx, id, dto.Provenance, false)
+		if err != nil {
+			return err
+		}
+
+		err = r.recordHistory(ctx, tx, id, HistoryCreate, actor)
+		if err != nil {
+			return err
+		}
+
+		return r.saveCreateJob(ctx, tx, jobs.ID(ctx), id)
+	})
 	if err != nil {
 		logger.Error(r.log, "error during execution", err)
 		return "", err
@@ -46,128 +95,1510 @@ func (r *repository) saveUser(ctx context.Context, dto *UserResponseDto) (string
 	return id, nil
 }
 
-func (r *repository) getAllUsers(ctx context.Context, opt ...string) ([]*UserResponseDto, error) {
-	var orderBy, query string
-	limit := 3 // default limit
+// saveCreateJob remembers the user created by the job, so that a retry of the job does not create it again.
+// Outside of jobs jobID is empty and nothing is stored.
+func (r *repository) saveCreateJob(ctx context.Context, tx pgx.Tx, jobID, userID string) error {
+	if jobID == "" {
+		return nil
+	}
+
+	query := `
+		INSERT INTO user_create_jobs (job_id, user_id)
+		VALUES ($1, $2)
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	_, err := tx.Exec(ctx, query, jobID, userID)
+
+	return err
+}
+
+// getCreatedUser returns the id of the user created by the job.
+func (r *repository) getCreatedUser(ctx context.Context, jobID string) (string, error) {
+	query := `
+		SELECT user_id
+		FROM effective.public.user_create_jobs
+		WHERE job_id = $1
+	`
+
+	var id string
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	err := r.pool.QueryRow(ctx, query, jobID).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		logger.Error(r.log, "error during scanning", err)
+		return "", err
+	}
+
+	return id, nil
+}
 
-	if len(opt) != 0 {
-		orderBy = opt[0]
+// saveUsers creates users in bulk with COPY and returns their ids in the order of dtos.
+func (r *repository) saveUsers(ctx context.Context, dtos []*UserResponseDto, actor string) ([]string, error) {
+	var ids []string
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		var err error
+		ids, err = r.saveUsersTx(ctx, tx, dtos, actor)
+		return err
+	})
+	if err != nil {
+		logger.Error(r.log, "error during bulk insert", err)
+		return nil, err
 	}
 
-	if opt[1] != "" {
-		i, _ := strconv.ParseInt(opt[1], 10, 64)
-		limit = int(i)
+	return ids, nil
+}
+
+// saveUsersTx creates users in bulk with COPY, ids are taken from the sequence beforehand,
+// since COPY can not return them.
+func (r *repository) saveUsersTx(ctx context.Context, tx pgx.Tx, dtos []*UserResponseDto, actor string) ([]string, error) {
+	if len(dtos) == 0 {
+		return nil, nil
 	}
 
-	switch orderBy {
-	case SORT_BY_ASC_AGE:
-		query = `
-		SELECT id, last_name, first_name, second_name, age, gender, nationality 
-		FROM effective.public.users
-		ORDER BY age
-		LIMIT $1
-	`
-	case SORT_BY_DESC_AGE:
-		query = `
-		SELECT id, last_name, first_name, second_name, age, gender, nationality 
-		FROM effective.public.users
-		ORDER BY age DESC 
-		LIMIT $1
-	`
-	default:
-		query = `
-		SELECT id, last_name, first_name, second_name, age, gender, nationality 
-		FROM effective.public.users	
-		ORDER BY created_at 
-		LIMIT $1
+	idsQuery := `
+		SELECT nextval('users_id_seq')
+		FROM generate_series(1, $1)
 	`
+
+	userColumns := []string{
+		"id", "last_name", "first_name", "second_name", "age", "gender", "nationality",
+		"enrichment_status", "age_count", "gender_probability", "enrichment_key", "enriched_at",
+		"last_name_translit", "first_name_translit", "second_name_translit",
+		"last_name_phonetic", "first_name_phonetic", "second_name_phonetic",
 	}
 
-	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
-	rows, err := r.pool.Query(ctx, query, limit)
+	ids := make([]string, 0, len(dtos))
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(idsQuery)))
+	rows, err := tx.Query(ctx, idsQuery, len(dtos))
 	if err != nil {
-		logger.Error(r.log, "error during query", err)
 		return nil, err
 	}
-	defer rows.Close()
 
-	var res []*UserResponseDto
 	for rows.Next() {
-		var dto UserResponseDto
-		err = rows.Scan(&dto.ID, &dto.LastName, &dto.FirstName, &dto.SecondName, &dto.Age, &dto.Gender, &dto.Nationality)
+		var id int64
+		err = rows.Scan(&id)
 		if err != nil {
-			logger.Error(r.log, "error during scanning", err)
+			rows.Close()
 			return nil, err
 		}
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-		res = append(res, &dto)
+	now := time.Now()
+	var users, nationalities, provenance [][]any
+	for i, dto := range dtos {
+		keys := withNameKeys(map[string]any{
+			"last_name":   dto.LastName,
+			"first_name":  dto.FirstName,
+			"second_name": dto.SecondName,
+		})
+
+		users = append(users, []any{
+			ids[i], dto.LastName, dto.FirstName, dto.SecondName, dto.Age, dto.Gender, dto.Nationality,
+			dto.Status, dto.Enrichment.AgeCount, dto.Enrichment.GenderProbability, dto.Enrichment.LookupKey, now,
+			keys["last_name_translit"], keys["first_name_translit"], keys["second_name_translit"],
+			keys["last_name_phonetic"], keys["first_name_phonetic"], keys["second_name_phonetic"],
+		})
+
+		for rank, n := range dto.Enrichment.Nationalities {
+			nationalities = append(nationalities, []any{ids[i], rank + 1, n.CountryID, n.Probability})
+		}
+
+		for field, p := range dto.Provenance {
+			provenance = append(provenance, []any{ids[i], field, p.Source, p.Actor, p.UpdatedAt})
+		}
 	}
 
-	return res, nil
+	r.log.Info("database copy", slog.String("table", "users"), slog.Int("rows", len(users)))
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"users"}, userColumns, pgx.CopyFromRows(users))
+	if err != nil {
+		return nil, err
+	}
+
+	r.log.Info("database copy", slog.String("table", "user_nationalities"), slog.Int("rows", len(nationalities)))
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"user_nationalities"}, []string{"user_id", "rank", "country_id", "probability"}, pgx.CopyFromRows(nationalities))
+	if err != nil {
+		return nil, err
+	}
+
+	r.log.Info("database copy", slog.String("table", "user_field_provenance"), slog.Int("rows", len(provenance)))
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"user_field_provenance"}, []string{"user_id", "field", "source", "actor", "updated_at"}, pgx.CopyFromRows(provenance))
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.recordHistories(ctx, tx, ids, HistoryCreate, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
 }
 
-func (r *repository) getUser(ctx context.Context, id string) (*UserResponseDto, error) {
+// userImport is an upload waiting for its import job, data is read from its chunks.
+type userImport struct {
+	format string
+	actor  string
+	data   io.Reader
+}
+
+// saveImport stores the upload in chunks of importChunkSize as it is read, so it is never held in memory as a whole.
+func (r *repository) saveImport(ctx context.Context, upload *userImport) (string, error) {
 	query := `
-		SELECT id, last_name, first_name, second_name, age, gender, nationality
-		FROM effective.public.users
-		WHERE id = $1
+		INSERT INTO user_imports (format, actor)
+		VALUES ($1, $2)
+		RETURNING id
+	`
+
+	chunkQuery := `
+		INSERT INTO user_import_chunks (import_id, seq, data)
+		VALUES ($1, $2, $3)
 	`
 
-	var dto UserResponseDto
+	var id string
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+		err := tx.QueryRow(ctx, query, upload.format, upload.actor).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(chunkQuery)))
+		chunk := make([]byte, importChunkSize)
+		for seq := 1; ; seq++ {
+			n, readErr := io.ReadFull(upload.data, chunk)
+			if n != 0 {
+				_, err = tx.Exec(ctx, chunkQuery, id, seq, chunk[:n])
+				if err != nil {
+					return err
+				}
+			}
 
+			if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			if readErr != nil {
+				return readErr
+			}
+		}
+	})
+	if err != nil {
+		logger.Error(r.log, "error during saving import", err)
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (r *repository) getImport(ctx context.Context, id string) (*userImport, error) {
+	query := `
+		SELECT format, actor
+		FROM effective.public.user_imports
+		WHERE id = $1
+	`
+
+	var upload userImport
 	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
-	err := r.pool.QueryRow(ctx, query, id).Scan(&dto.ID, &dto.LastName, &dto.FirstName, &dto.SecondName, &dto.Age, &dto.Gender, &dto.Nationality)
+	err := r.pool.QueryRow(ctx, query, id).Scan(&upload.format, &upload.actor)
 	if err != nil {
 		logger.Error(r.log, "error during scanning", err)
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrNotFound
-		} else {
-			return nil, err
 		}
+		return nil, err
 	}
 
-	return &dto, nil
+	upload.data = &chunkReader{ctx: ctx, repository: r, importID: id}
+
+	return &upload, nil
 }
 
-func (r *repository) updateUser(ctx context.Context, id, col string, val any) error {
-	query := fmt.Sprintf(`
-		UPDATE users
-		SET %s = $1
-		WHERE id = $2
-`, col)
+// chunkReader reads the chunks of an upload one at a time.
+type chunkReader struct {
+	ctx        context.Context
+	repository *repository
+	importID   string
+	seq        int
+	chunk      []byte
+	done       bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+
+		chunk, err := c.repository.getImportChunk(c.ctx, c.importID, c.seq+1)
+		if errors.Is(err, ErrNotFound) {
+			c.done = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		c.seq++
+		c.chunk = chunk
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+
+	return n, nil
+}
+
+func (r *repository) getImportChunk(ctx context.Context, id string, seq int) ([]byte, error) {
+	query := `
+		SELECT data
+		FROM effective.public.user_import_chunks
+		WHERE import_id = $1 AND seq = $2
+	`
 
+	var data []byte
 	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
-	exec, err := r.pool.Exec(ctx, query, val, id)
+	err := r.pool.QueryRow(ctx, query, id, seq).Scan(&data)
 	if err != nil {
-		logger.Error(r.log, "error during execution", err)
 		if errors.Is(err, pgx.ErrNoRows) {
-			return ErrNotFound
-		} else {
+			return nil, ErrNotFound
+		}
+		logger.Error(r.log, "error during scanning", err)
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// saveImportBatch saves the users of a batch of an import and records the outcome of its rows in one
+// transaction, so a resumed import neither loses nor duplicates the batch. The ids and statuses of the
+// saved users are set in rows, see setImportedRows.
+func (r *repository) saveImportBatch(ctx context.Context, id string, seq int, dtos []*UserResponseDto, rows []ImportRowDto, actor string) error {
+	query := `
+		INSERT INTO user_import_batches (import_id, seq, rows)
+		VALUES ($1, $2, $3)
+	`
+
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		ids, err := r.saveUsersTx(ctx, tx, dtos, actor)
+		if err != nil {
 			return err
 		}
+		setImportedRows(rows, dtos, ids, nil)
+
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+		_, err = tx.Exec(ctx, query, id, seq, rows)
+		return err
+	})
+	if err != nil {
+		logger.Error(r.log, "error during saving import batch", err)
+		return err
 	}
-	r.log.Info("result of execution", slog.Int("rows affected", int(exec.RowsAffected())))
 
 	return nil
 }
 
-func (r *repository) deleteUser(ctx context.Context, id string) error {
+// getImportRows returns the rows of the batches of an import recorded so far in the order of the upload,
+// and the number of the batches.
+func (r *repository) getImportRows(ctx context.Context, id string) ([]ImportRowDto, int, error) {
 	query := `
-		DELETE FROM effective.public.users
+		SELECT rows
+		FROM effective.public.user_import_batches
+		WHERE import_id = $1
+		ORDER BY seq
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	rows, err := r.pool.Query(ctx, query, id)
+	if err != nil {
+		logger.Error(r.log, "error during query", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var res []ImportRowDto
+	var batches int
+	for rows.Next() {
+		var batch []ImportRowDto
+		err = rows.Scan(&batch)
+		if err != nil {
+			logger.Error(r.log, "error during scanning", err)
+			return nil, 0, err
+		}
+
+		res = append(res, batch...)
+		batches++
+	}
+
+	return res, batches, rows.Err()
+}
+
+func (r *repository) deleteImport(ctx context.Context, id string) error {
+	query := `
+		DELETE FROM user_imports
 		WHERE id = $1
 	`
 
 	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
-	exec, err := r.pool.Exec(ctx, query, id)
+	_, err := r.pool.Exec(ctx, query, id)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	return nil
+}
+
+// claimIdempotencyKey locks the key for the request with the given hash and reports whether it succeeded.
+// Expired keys are taken over, so are keys locked by a request with the same hash whose lease has run out.
+func (r *repository) claimIdempotencyKey(ctx context.Context, key, requestHash string, lease, ttl time.Duration) (bool, error) {
+	query := `
+		INSERT INTO idempotency_keys (key, request_hash, locked_until, expires_at)
+		VALUES ($1, $2, now() + make_interval(secs => $3), now() + make_interval(secs => $4))
+		ON CONFLICT (key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash,
+			status_code = NULL,
+			headers = NULL,
+			body = NULL,
+			locked_until = EXCLUDED.locked_until,
+			created_at = now(),
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < now()
+		   OR (idempotency_keys.status_code IS NULL
+		       AND idempotency_keys.locked_until < now()
+		       AND idempotency_keys.request_hash = EXCLUDED.request_hash)
+		RETURNING true
+	`
+
+	var claimed bool
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	err := r.pool.QueryRow(ctx, query, key, requestHash, lease.Seconds(), ttl.Seconds()).Scan(&claimed)
 	if err != nil {
-		logger.Error(r.log, "error during scanning", err)
 		if errors.Is(err, pgx.ErrNoRows) {
-			return ErrNotFound
-		} else {
-			return err
+			return false, nil
 		}
+		logger.Error(r.log, "error during execution", err)
+		return false, err
+	}
+
+	return claimed, nil
+}
+
+// getIdempotencyKey returns the request the key was used for, its response is not set while the request is in progress.
+func (r *repository) getIdempotencyKey(ctx context.Context, key string) (*idempotentRequest, error) {
+	query := `
+		SELECT request_hash, status_code, headers, body
+		FROM effective.public.idempotency_keys
+		WHERE key = $1 AND expires_at >= now()
+	`
+
+	var req idempotentRequest
+	var status *int
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	err := r.pool.QueryRow(ctx, query, key).Scan(&req.hash, &status, &req.headers, &req.body)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		logger.Error(r.log, "error during scanning", err)
+		return nil, err
+	}
+
+	if status != nil {
+		req.status = *status
+	}
+
+	return &req, nil
+}
+
+// saveIdempotentResponse stores the response of the request holding the key and unlocks it.
+func (r *repository) saveIdempotentResponse(ctx context.Context, key string, req *idempotentRequest) error {
+	query := `
+		UPDATE idempotency_keys
+		SET status_code = $1,
+			headers = $2,
+			body = $3,
+			locked_until = NULL
+		WHERE key = $4 AND request_hash = $5
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	_, err := r.pool.Exec(ctx, query, req.status, req.headers, req.body, key, req.hash)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	return nil
+}
+
+// releaseIdempotencyKey removes a key without a response, so the request can be retried.
+func (r *repository) releaseIdempotencyKey(ctx context.Context, key, requestHash string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE key = $1 AND request_hash = $2 AND status_code IS NULL
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	_, err := r.pool.Exec(ctx, query, key, requestHash)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
 	}
-	r.log.Info("result of execution", slog.Int("rows affected", int(exec.RowsAffected())))
 
 	return nil
 }
+
+func (r *repository) deleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at < now()
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	tag, err := r.pool.Exec(ctx, query)
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// saveNationalities replaces nationality candidates of the user, empty list keeps the previous ones.
+func (r *repository) saveNationalities(ctx context.Context, tx pgx.Tx, id string, nationalities []NationalityDto) error {
+	if len(nationalities) == 0 {
+		return nil
+	}
+
+	deleteQuery := `
+		DELETE FROM user_nationalities
+		WHERE user_id = $1
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(deleteQuery)))
+	_, err := tx.Exec(ctx, deleteQuery, id)
+	if err != nil {
+		return err
+	}
+
+	insertQuery := `
+		INSERT INTO user_nationalities (user_id, rank, country_id, probability)
+		SELECT $1, n.rank, n.country_id, n.probability
+		FROM unnest($2::text[], $3::real[]) WITH ORDINALITY AS n(country_id, probability, rank)
+	`
+
+	countries := make([]string, len(nationalities))
+	probabilities := make([]float32, len(nationalities))
+	for i, n := range nationalities {
+		countries[i] = n.CountryID
+		probabilities[i] = n.Probability
+	}
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(insertQuery)))
+	_, err = tx.Exec(ctx, insertQuery, id, countries, probabilities)
+
+	return err
+}
+
+// saveProvenance upserts provenance of the given fields. With keepOverrides manual and imported values
+// always win, values from other sources never replace them. Timestamps are taken from the
+// entries, so unchanged entries read before are written back as they were.
+func (r *repository) saveProvenance(ctx context.Context, tx pgx.Tx, id string, provenance map[string]ProvenanceDto, keepOverrides bool) error {
+	if len(provenance) == 0 {
+		return nil
+	}
+
+	query := `
+		INSERT INTO user_field_provenance (user_id, field, source, actor, updated_at)
+		SELECT $1, p.field, p.source, p.actor, p.updated_at
+		FROM unnest($2::text[], $3::text[], $4::text[], $5::timestamptz[]) AS p(field, source, actor, updated_at)
+		ON CONFLICT (user_id, field) DO UPDATE
+		SET source = excluded.source,
+			actor = excluded.actor,
+			updated_at = excluded.updated_at
+		WHERE NOT $7 OR excluded.source = ANY($6) OR user_field_provenance.source <> ALL($6)
+	`
+
+	fields := make([]string, 0, len(provenance))
+	sources := make([]string, 0, len(provenance))
+	actors := make([]string, 0, len(provenance))
+	updatedAt := make([]time.Time, 0, len(provenance))
+	for field, p := range provenance {
+		fields = append(fields, field)
+		sources = append(sources, p.Source)
+		actors = append(actors, p.Actor)
+		updatedAt = append(updatedAt, p.UpdatedAt)
+	}
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	_, err := tx.Exec(ctx, query, id, fields, sources, actors, updatedAt, overrideSources, keepOverrides)
+
+	return err
+}
+
+// deleteProvenance forgets where the fields of the user came from.
+func (r *repository) deleteProvenance(ctx context.Context, tx pgx.Tx, id string, fields []string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	query := `
+		DELETE FROM user_field_provenance
+		WHERE user_id = $1 AND field = ANY($2)
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	_, err := tx.Exec(ctx, query, id, fields)
+
+	return err
+}
+
+func (r *repository) getProvenance(ctx context.Context, id string) (map[string]ProvenanceDto, error) {
+	query := `
+		SELECT field, source, actor, updated_at
+		FROM effective.public.user_field_provenance
+		WHERE user_id = $1
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	rows, err := r.pool.Query(ctx, query, id)
+	if err != nil {
+		logger.Error(r.log, "error during query", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]ProvenanceDto)
+	for rows.Next() {
+		var field string
+		var dto ProvenanceDto
+		err = rows.Scan(&field, &dto.Source, &dto.Actor, &dto.UpdatedAt)
+		if err != nil {
+			logger.Error(r.log, "error during scanning", err)
+			return nil, err
+		}
+
+		res[field] = dto
+	}
+
+	return res, rows.Err()
+}
+
+func (r *repository) getNationalities(ctx context.Context, id string) ([]NationalityDto, error) {
+	query := `
+		SELECT country_id, probability
+		FROM effective.public.user_nationalities
+		WHERE user_id = $1
+		ORDER BY rank
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	rows, err := r.pool.Query(ctx, query, id)
+	if err != nil {
+		logger.Error(r.log, "error during query", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []NationalityDto{}
+	for rows.Next() {
+		var dto NationalityDto
+		err = rows.Scan(&dto.CountryID, &dto.Probability)
+		if err != nil {
+			logger.Error(r.log, "error during scanning", err)
+			return nil, err
+		}
+
+		res = append(res, dto)
+	}
+
+	return res, rows.Err()
+}
+
+// getAllUsers fetches one row more than the page limit, so callers can tell whether the page is the last one.
+func (r *repository) getAllUsers(ctx context.Context, filter *usersFilter, page *pageRequest) ([]*UserResponseDto, error) {
+	var args queryArgs
+	conds := filter.conditions(&args)
+
+	order := page.queryOrder()
+	if page.cursor != nil {
+		conds = append(conds, order.after(page.cursor.Values, &args))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, last_name, first_name, second_name, age, gender, nationality, enrichment_status, version, created_at, deleted_at
+		FROM effective.public.users
+		%s
+		ORDER BY %s
+		LIMIT %s
+	`, where(conds), order.orderBy(), args.add(page.limit+1))
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		logger.Error(r.log, "error during query", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []*UserResponseDto
+	for rows.Next() {
+		var dto UserResponseDto
+		err = rows.Scan(&dto.ID, &dto.LastName, &dto.FirstName, &dto.SecondName, &dto.Age, &dto.Gender, &dto.Nationality, &dto.Status, &dto.Version, &dto.CreatedAt, &dto.DeletedAt)
+		if err != nil {
+			logger.Error(r.log, "error during scanning", err)
+			return nil, err
+		}
+
+		res = append(res, &dto)
+	}
+
+	return res, rows.Err()
+}
+
+func (r *repository) countUsers(ctx context.Context, filter *usersFilter) (int, error) {
+	var args queryArgs
+	query := fmt.Sprintf(`
+		SELECT count(*)
+		FROM effective.public.users
+		%s
+	`, where(filter.conditions(&args)))
+
+	var count int
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	err := r.pool.QueryRow(ctx, query, args...).Scan(&count)
+	if err != nil {
+		logger.Error(r.log, "error during scanning", err)
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// exportUsers passes the users matching the filter to fn in the order of ids. Rows are fetched from
+// a server side cursor in batches of exportBatchSize, an error of fn stops the export.
+func (r *repository) exportUsers(ctx context.Context, filter *usersFilter, fn func(*UserResponseDto) error) error {
+	var args queryArgs
+	declareQuery := fmt.Sprintf(`
+		DECLARE users_export NO SCROLL CURSOR FOR
+		SELECT id, last_name, first_name, second_name, age, gender, nationality, enrichment_status, version, created_at, deleted_at
+		FROM effective.public.users
+		%s
+		ORDER BY id
+	`, where(filter.conditions(&args)))
+
+	fetchQuery := fmt.Sprintf(`
+		FETCH FORWARD %d FROM users_export
+	`, exportBatchSize)
+
+	err := pgx.BeginTxFunc(ctx, r.pool, pgx.TxOptions{AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(declareQuery)))
+		_, err := tx.Exec(ctx, declareQuery, args...)
+		if err != nil {
+			return err
+		}
+
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(fetchQuery)))
+		for {
+			rows, err := tx.Query(ctx, fetchQuery)
+			if err != nil {
+				return err
+			}
+
+			var fetched int
+			for rows.Next() {
+				fetched++
+
+				var dto UserResponseDto
+				err = rows.Scan(&dto.ID, &dto.LastName, &dto.FirstName, &dto.SecondName, &dto.Age, &dto.Gender, &dto.Nationality, &dto.Status, &dto.Version, &dto.CreatedAt, &dto.DeletedAt)
+				if err == nil {
+					err = fn(&dto)
+				}
+				if err != nil {
+					rows.Close()
+					return err
+				}
+			}
+			if err = rows.Err(); err != nil {
+				return err
+			}
+
+			if fetched < exportBatchSize {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		logger.Error(r.log, "error during export", err)
+		return err
+	}
+
+	return nil
+}
+
+// searchUsers ranks users by trigram word similarity of q to their full name, both as entered and
+// transliterated, users whose name has the same phonetic key as a word of q get at least phoneticScore.
+// Users below the threshold are not returned.
+func (r *repository) searchUsers(ctx context.Context, q string, threshold float32, limit int) ([]*SearchResultDto, error) {
+	thresholdQuery := `
+		SELECT set_config('pg_trgm.word_similarity_threshold', $1, true)
+	`
+
+	query := `
+		SELECT id, last_name, first_name, second_name, age, gender, nationality, enrichment_status, version, created_at,
+			GREATEST(
+				word_similarity($1, full_name),
+				word_similarity($2, full_name_translit),
+				CASE WHEN phonetic_match THEN $3::real ELSE 0 END
+			) AS score
+		FROM (
+			SELECT *,
+				(last_name_phonetic = ANY($4) OR first_name_phonetic = ANY($4) OR second_name_phonetic = ANY($4)) AS phonetic_match
+			FROM effective.public.users
+			WHERE deleted_at IS NULL AND (
+				$1 <% full_name
+				OR $2 <% full_name_translit
+				OR last_name_phonetic = ANY($4)
+				OR first_name_phonetic = ANY($4)
+				OR second_name_phonetic = ANY($4)
+			)
+		) users
+		ORDER BY score DESC, id
+		LIMIT $5
+	`
+
+	var res []*SearchResultDto
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(thresholdQuery)))
+		_, err := tx.Exec(ctx, thresholdQuery, strconv.FormatFloat(float64(threshold), 'f', -1, 32))
+		if err != nil {
+			return err
+		}
+
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+		rows, err := tx.Query(ctx, query, q, names.Translit(q), phoneticScore, phoneticKeys(q), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var dto UserResponseDto
+			var score float32
+			err = rows.Scan(&dto.ID, &dto.LastName, &dto.FirstName, &dto.SecondName, &dto.Age, &dto.Gender, &dto.Nationality, &dto.Status, &dto.Version, &dto.CreatedAt, &score)
+			if err != nil {
+				return err
+			}
+
+			res = append(res, &SearchResultDto{User: &dto, Score: score})
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		logger.Error(r.log, "error during search", err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// findDuplicates returns ids of users whose transliterated full name equals the one of dto.
+// Fuzzy matching also accepts similar full names and the same phonetic last and first names.
+func (r *repository) findDuplicates(ctx context.Context, dto *UserRequestDto, fuzzy bool, limit int) ([]string, error) {
+	thresholdQuery := `
+		SELECT set_config('pg_trgm.similarity_threshold', $1, true)
+	`
+
+	query := `
+		SELECT id
+		FROM effective.public.users
+		WHERE deleted_at IS NULL AND (
+			(last_name_translit = $1 AND first_name_translit = $2 AND COALESCE(second_name_translit, '') = $3)
+			OR ($4 AND (
+				(last_name_phonetic = $5 AND first_name_phonetic = $6)
+				OR full_name_translit % $7
+			))
+		)
+		ORDER BY id
+		LIMIT $8
+	`
+
+	lastName, firstName, secondName := names.Translit(dto.LastName), names.Translit(dto.FirstName), names.Translit(dto.SecondName)
+	fullName := lastName + " " + firstName + " " + secondName
+
+	var res []string
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(thresholdQuery)))
+		_, err := tx.Exec(ctx, thresholdQuery, strconv.FormatFloat(duplicateThreshold, 'f', -1, 32))
+		if err != nil {
+			return err
+		}
+
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+		rows, err := tx.Query(ctx, query,
+			lastName, firstName, secondName,
+			fuzzy, names.Phonetic(dto.LastName), names.Phonetic(dto.FirstName), fullName,
+			limit,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id string
+			err = rows.Scan(&id)
+			if err != nil {
+				return err
+			}
+
+			res = append(res, id)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		logger.Error(r.log, "error during duplicates lookup", err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (r *repository) getUser(ctx context.Context, id string) (*UserResponseDto, error) {
+	query := `
+		SELECT id, last_name, first_name, second_name, age, gender, nationality, enrichment_status, version, created_at, age_count, gender_probability, enrichment_key
+		FROM effective.public.users
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+
+	dto := UserResponseDto{
+		Enrichment: &EnrichmentDto{},
+	}
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	err := r.pool.QueryRow(ctx, query, id).Scan(&dto.ID, &dto.LastName, &dto.FirstName, &dto.SecondName, &dto.Age, &dto.Gender, &dto.Nationality, &dto.Status, &dto.Version, &dto.CreatedAt, &dto.Enrichment.AgeCount, &dto.Enrichment.GenderProbability, &dto.Enrichment.LookupKey)
+	if err != nil {
+		logger.Error(r.log, "error during scanning", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		} else {
+			return nil, err
+		}
+	}
+
+	dto.Enrichment.Nationalities, err = r.getNationalities(ctx, dto.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	dto.Provenance, err = r.getProvenance(ctx, dto.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto, nil
+}
+
+// getUsersToReEnrich returns ids of users that are pending, stale or have low confidence data.
+// Pending and low confidence users are retried with exponential backoff, up to maxReEnrichAttempts
+// re-enrichments in a row that changed nothing, then only once they are stale.
+func (r *repository) getUsersToReEnrich(ctx context.Context, cfg *schedulerConfig, limit int) ([]string, error) {
+	query := `
+		SELECT id
+		FROM effective.public.users
+		WHERE deleted_at IS NULL AND (
+			enriched_at IS NULL
+			OR enriched_at < now() - make_interval(secs => $3)
+			OR (enrichment_attempts < $7 AND (
+				(enrichment_status = $1 AND enriched_at < now() - make_interval(secs => $2 * 2 ^ enrichment_attempts))
+				OR (gender_probability < $4 AND enriched_at < now() - make_interval(secs => $5 * 2 ^ enrichment_attempts))
+			))
+		)
+		ORDER BY enriched_at NULLS FIRST
+		LIMIT $6
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	rows, err := r.pool.Query(ctx, query,
+		StatusPending, cfg.pendingAfter.Seconds(),
+		cfg.staleAfter.Seconds(),
+		cfg.minGenderProbability, cfg.lowConfidenceAfter.Seconds(),
+		limit, maxReEnrichAttempts,
+	)
+	if err != nil {
+		logger.Error(r.log, "error during query", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			logger.Error(r.log, "error during scanning", err)
+			return nil, err
+		}
+
+		res = append(res, id)
+	}
+
+	return res, rows.Err()
+}
+
+// saveEnrichment stores enriched values, fields with manual or import provenance are left untouched
+// and the confidence of the providers is cleared for them.
+// A new version with its history entry is only produced if the fields or the status change,
+// otherwise the re-enrichment is counted in enrichment_attempts so that the scheduler backs off.
+func (r *repository) saveEnrichment(ctx context.Context, dto *UserResponseDto) error {
+	query := `
+		WITH enriched AS (
+			SELECT u.id, v.age, v.gender, v.nationality, v.age_count, v.gender_probability,
+				(u.age, u.gender, u.nationality, u.enrichment_status) IS DISTINCT FROM (v.age, v.gender, v.nationality, v.status) AS changed
+			FROM users u
+			CROSS JOIN (
+				SELECT array_agg(field) AS fields
+				FROM user_field_provenance
+				WHERE user_id = $7 AND source = ANY($8)
+			) m
+			CROSS JOIN LATERAL (
+				SELECT CASE WHEN 'age' = ANY(m.fields) THEN u.age ELSE COALESCE($1, u.age) END AS age,
+					CASE WHEN 'gender' = ANY(m.fields) THEN u.gender ELSE COALESCE($2, u.gender) END AS gender,
+					CASE WHEN 'nationality' = ANY(m.fields) THEN u.nationality ELSE COALESCE($3, u.nationality) END AS nationality,
+					CASE WHEN 'age' = ANY(m.fields) THEN NULL ELSE COALESCE($4, u.age_count) END AS age_count,
+					CASE WHEN 'gender' = ANY(m.fields) THEN NULL ELSE COALESCE($5, u.gender_probability) END AS gender_probability,
+					$6::enrichment_status AS status
+			) v
+			WHERE u.id = $7 AND u.deleted_at IS NULL
+			FOR UPDATE OF u
+		)
+		UPDATE users u
+		SET age = e.age,
+			gender = e.gender,
+			nationality = e.nationality,
+			age_count = e.age_count,
+			gender_probability = e.gender_probability,
+			enrichment_status = $6,
+			enrichment_key = COALESCE($9, u.enrichment_key),
+			enriched_at = now(),
+			enrichment_attempts = CASE WHEN e.changed THEN 0 ELSE u.enrichment_attempts + 1 END,
+			version = CASE WHEN e.changed THEN u.version + 1 ELSE u.version END
+		FROM enriched e
+		WHERE u.id = e.id
+		RETURNING e.changed
+	`
+
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		var changed bool
+
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+		err := tx.QueryRow(ctx, query, dto.Age, dto.Gender, dto.Nationality, dto.Enrichment.AgeCount, dto.Enrichment.GenderProbability, dto.Status, dto.ID, overrideSources, dto.Enrichment.LookupKey).Scan(&changed)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		r.log.Info("result of execution", slog.Bool("changed", changed))
+
+		err = r.saveNationalities(ctx, tx, dto.ID, dto.Enrichment.Nationalities)
+		if err != nil {
+			return err
+		}
+
+		if !changed {
+			return nil
+		}
+
+		err = r.saveProvenance(ctx, tx, dto.ID, dto.Provenance, true)
+		if err != nil {
+			return err
+		}
+
+		return r.recordHistory(ctx, tx, dto.ID, HistoryEnrich, ActorSystem)
+	})
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	return nil
+}
+
+// updateUser applies all changes with a single UPDATE, column names must come from the patch whitelist.
+// Non-nil versions make the update conditional on the current version being one of them.
+func (r *repository) updateUser(ctx context.Context, id string, changes map[string]any, actor string, versions []int) error {
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		err := r.updateUserTx(ctx, tx, id, changes, manualProvenance(changes, actor), versions)
+		if err != nil {
+			return err
+		}
+
+		return r.recordHistory(ctx, tx, id, HistoryUpdate, actor)
+	})
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	return nil
+}
+
+// updateUserTx writes the changes, provenance describes the derived fields among them.
+func (r *repository) updateUserTx(ctx context.Context, tx pgx.Tx, id string, changes map[string]any, provenance map[string]ProvenanceDto, versions []int) error {
+	changes = withNameKeys(changes)
+	withoutOverriddenConfidence(changes, provenance)
+
+	cols := make([]string, 0, len(changes))
+	for col := range changes {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+
+	sets := make([]string, len(cols))
+	args := make([]any, len(cols), len(cols)+1)
+	for i, col := range cols {
+		sets[i] = fmt.Sprintf("%s = $%d", col, i+1)
+		args[i] = changes[col]
+	}
+	args = append(args, id, versions)
+
+	query := fmt.Sprintf(`
+		UPDATE users
+		SET %s, version = version + 1
+		WHERE id = $%d AND deleted_at IS NULL AND ($%d::integer[] IS NULL OR version = ANY($%d))
+	`, strings.Join(sets, ", "), len(args)-1, len(args), len(args))
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	exec, err := tx.Exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	r.log.Info("result of execution", slog.Int("rows affected", int(exec.RowsAffected())))
+
+	if exec.RowsAffected() == 0 {
+		return r.missingOrChanged(ctx, tx, id)
+	}
+
+	return r.saveProvenance(ctx, tx, id, provenance, false)
+}
+
+// manualProvenance records the derived fields among changes as set manually by actor.
+func manualProvenance(changes map[string]any, actor string) map[string]ProvenanceDto {
+	provenance := make(map[string]ProvenanceDto)
+	for field := range changes {
+		if isDerivedField(field) {
+			provenance[field] = ProvenanceDto{Source: SourceManual, Actor: actor, UpdatedAt: time.Now()}
+		}
+	}
+
+	return provenance
+}
+
+// deleteUser marks the user as deleted, non-nil versions make it conditional like in updateUser.
+func (r *repository) deleteUser(ctx context.Context, id, actor string, versions []int) error {
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		err := r.deleteUserTx(ctx, tx, id, versions)
+		if err != nil {
+			return err
+		}
+
+		return r.recordHistory(ctx, tx, id, HistoryDelete, actor)
+	})
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *repository) deleteUserTx(ctx context.Context, tx pgx.Tx, id string, versions []int) error {
+	query := `
+		UPDATE users
+		SET deleted_at = now(), version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL AND ($2::integer[] IS NULL OR version = ANY($2))
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	exec, err := tx.Exec(ctx, query, id, versions)
+	if err != nil {
+		return err
+	}
+	r.log.Info("result of execution", slog.Int("rows affected", int(exec.RowsAffected())))
+
+	if exec.RowsAffected() == 0 {
+		return r.missingOrChanged(ctx, tx, id)
+	}
+
+	return nil
+}
+
+// restoreUser clears the deletion mark of the user, ErrNotDeleted is returned for users that are not deleted.
+func (r *repository) restoreUser(ctx context.Context, id, actor string, versions []int) error {
+	query := `
+		UPDATE users
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL AND ($2::integer[] IS NULL OR version = ANY($2))
+	`
+
+	checkQuery := `
+		SELECT deleted_at IS NOT NULL
+		FROM effective.public.users
+		WHERE id = $1
+	`
+
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+		exec, err := tx.Exec(ctx, query, id, versions)
+		if err != nil {
+			return err
+		}
+		r.log.Info("result of execution", slog.Int("rows affected", int(exec.RowsAffected())))
+
+		if exec.RowsAffected() != 0 {
+			return r.recordHistory(ctx, tx, id, HistoryRestore, actor)
+		}
+
+		var deleted bool
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(checkQuery)))
+		err = tx.QueryRow(ctx, checkQuery, id).Scan(&deleted)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrNotFound
+		case err != nil:
+			return err
+		case deleted:
+			return ErrVersionMismatch
+		default:
+			return ErrNotDeleted
+		}
+	})
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	return nil
+}
+
+// purgeUser removes the user permanently, deleted or not. History of the user is kept.
+func (r *repository) purgeUser(ctx context.Context, id, actor string, versions []int) error {
+	versionQuery := `
+		UPDATE users
+		SET version = version + 1
+		WHERE id = $1 AND ($2::integer[] IS NULL OR version = ANY($2))
+	`
+
+	checkQuery := `
+		SELECT EXISTS (SELECT 1 FROM effective.public.users WHERE id = $1)
+	`
+
+	query := `
+		DELETE FROM effective.public.users
+		WHERE id = $1
+	`
+
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(versionQuery)))
+		exec, err := tx.Exec(ctx, versionQuery, id, versions)
+		if err != nil {
+			return err
+		}
+		r.log.Info("result of execution", slog.Int("rows affected", int(exec.RowsAffected())))
+
+		if exec.RowsAffected() == 0 {
+			var exists bool
+			r.log.Info("database query", slog.String("query", postgresql.FormatQuery(checkQuery)))
+			err = tx.QueryRow(ctx, checkQuery, id).Scan(&exists)
+			if err != nil {
+				return err
+			}
+
+			if exists {
+				return ErrVersionMismatch
+			}
+
+			return ErrNotFound
+		}
+
+		err = r.recordHistory(ctx, tx, id, HistoryPurge, actor)
+		if err != nil {
+			return err
+		}
+
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+		_, err = tx.Exec(ctx, query, id)
+		return err
+	})
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	return nil
+}
+
+// mergeUsers applies changes to target and deletes source in one transaction, the merge is recorded in user_merges
+// and in the history of both users.
+// Both users must still have the given versions.
+func (r *repository) mergeUsers(ctx context.Context, target, source *UserResponseDto, changes map[string]any, actor string) error {
+	query := `
+		INSERT INTO user_merges (target_id, source_id, source, changes, actor)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		var err error
+		if len(changes) != 0 {
+			err = r.updateUserTx(ctx, tx, target.ID, changes, mergeProvenance(changes, source, actor), []int{target.Version})
+		} else {
+			err = r.bumpVersion(ctx, tx, target.ID, target.Version)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = r.recordHistory(ctx, tx, target.ID, HistoryMerge, actor)
+		if err != nil {
+			return err
+		}
+
+		err = r.deleteUserTx(ctx, tx, source.ID, []int{source.Version})
+		if err != nil {
+			return err
+		}
+
+		err = r.recordHistory(ctx, tx, source.ID, HistoryDelete, actor)
+		if err != nil {
+			return err
+		}
+
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+		_, err = tx.Exec(ctx, query, target.ID, source.ID, source, changes, actor)
+		return err
+	})
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	return nil
+}
+
+// bumpVersion increments the version of the user if it still has the given one.
+func (r *repository) bumpVersion(ctx context.Context, tx pgx.Tx, id string, version int) error {
+	query := `
+		UPDATE users
+		SET version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	exec, err := tx.Exec(ctx, query, id, version)
+	if err != nil {
+		return err
+	}
+	r.log.Info("result of execution", slog.Int("rows affected", int(exec.RowsAffected())))
+
+	if exec.RowsAffected() == 0 {
+		return r.missingOrChanged(ctx, tx, id)
+	}
+
+	return nil
+}
+
+// snapshotColumns renders a users row as UserSnapshotDto.
+const snapshotColumns = `jsonb_build_object(
+	'last_name', last_name,
+	'first_name', first_name,
+	'second_name', second_name,
+	'age', age,
+	'gender', gender,
+	'nationality', nationality,
+	'status', enrichment_status,
+	'deleted_at', deleted_at,
+	'provenance', (
+		SELECT jsonb_object_agg(p.field, jsonb_build_object('source', p.source, 'actor', p.actor, 'updated_at', p.updated_at))
+		FROM effective.public.user_field_provenance p
+		WHERE p.user_id = users.id
+	)
+)`
+
+// revertUser sets all fields of the user to the ones of the version, a new version is produced.
+// Only fields that differ are written, so the provenance of the rest is kept.
+// Written derived fields get back the provenance they had in the version.
+func (r *repository) revertUser(ctx context.Context, id string, version int, actor string, versions []int) error {
+	currentQuery := fmt.Sprintf(`
+		SELECT version, %s
+		FROM effective.public.users
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR UPDATE
+	`, snapshotColumns)
+
+	snapshotQuery := `
+		SELECT snapshot
+		FROM effective.public.user_history
+		WHERE user_id = $1 AND version = $2
+	`
+
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		var current UserSnapshotDto
+		var currentVersion int
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(currentQuery)))
+		err := tx.QueryRow(ctx, currentQuery, id).Scan(&currentVersion, &current)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		if versions != nil && !slices.Contains(versions, currentVersion) {
+			return ErrVersionMismatch
+		}
+
+		var target UserSnapshotDto
+		r.log.Info("database query", slog.String("query", postgresql.FormatQuery(snapshotQuery)))
+		err = tx.QueryRow(ctx, snapshotQuery, id, version).Scan(&target)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("version %d: %w", version, ErrNotFound)
+			}
+			return err
+		}
+
+		changes := revertChanges(&current, &target)
+		if len(changes) != 0 {
+			provenance, unknown := revertProvenance(changes, &target)
+			err = r.updateUserTx(ctx, tx, id, changes, provenance, []int{currentVersion})
+			if err != nil {
+				return err
+			}
+
+			err = r.deleteProvenance(ctx, tx, id, unknown)
+		} else {
+			err = r.bumpVersion(ctx, tx, id, currentVersion)
+		}
+		if err != nil {
+			return err
+		}
+
+		return r.recordHistory(ctx, tx, id, HistoryRevert, actor)
+	})
+	if err != nil {
+		logger.Error(r.log, "error during execution", err)
+		return err
+	}
+
+	return nil
+}
+
+// recordHistory stores the current state of the user as the history entry of its version.
+// The request id is taken from ctx.
+func (r *repository) recordHistory(ctx context.Context, tx pgx.Tx, id, operation, actor string) error {
+	return r.recordHistories(ctx, tx, []string{id}, operation, actor)
+}
+
+func (r *repository) recordHistories(ctx context.Context, tx pgx.Tx, ids []string, operation, actor string) error {
+	query := fmt.Sprintf(`
+		INSERT INTO user_history (user_id, version, operation, snapshot, actor, request_id)
+		SELECT id, version, $2, %s, $3, NULLIF($4, '')
+		FROM effective.public.users
+		WHERE id = ANY($1::integer[])
+	`, snapshotColumns)
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	_, err := tx.Exec(ctx, query, ids, operation, actor, httpserver.RequestID(ctx))
+	return err
+}
+
+// getHistory returns all history entries of the user from the oldest one, purged users keep their history.
+func (r *repository) getHistory(ctx context.Context, id string) ([]*HistoryEntryDto, error) {
+	query := `
+		SELECT version, operation, snapshot, actor, COALESCE(request_id, ''), changed_at
+		FROM effective.public.user_history
+		WHERE user_id = $1
+		ORDER BY version
+	`
+
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	rows, err := r.pool.Query(ctx, query, id)
+	if err != nil {
+		logger.Error(r.log, "error during query", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []*HistoryEntryDto
+	for rows.Next() {
+		var dto HistoryEntryDto
+		err = rows.Scan(&dto.Version, &dto.Operation, &dto.Snapshot, &dto.Actor, &dto.RequestID, &dto.ChangedAt)
+		if err != nil {
+			logger.Error(r.log, "error during scanning", err)
+			return nil, err
+		}
+
+		res = append(res, &dto)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return res, nil
+}
+
+func (r *repository) getHistoryEntry(ctx context.Context, id string, version int) (*HistoryEntryDto, error) {
+	query := `
+		SELECT version, operation, snapshot, actor, COALESCE(request_id, ''), changed_at
+		FROM effective.public.user_history
+		WHERE user_id = $1 AND version = $2
+	`
+
+	var dto HistoryEntryDto
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	err := r.pool.QueryRow(ctx, query, id, version).Scan(&dto.Version, &dto.Operation, &dto.Snapshot, &dto.Actor, &dto.RequestID, &dto.ChangedAt)
+	if err != nil {
+		logger.Error(r.log, "error during scanning", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &dto, nil
+}
+
+// missingOrChanged explains why a conditional write affected no rows.
+func (r *repository) missingOrChanged(ctx context.Context, tx pgx.Tx, id string) error {
+	query := `
+		SELECT EXISTS (SELECT 1 FROM effective.public.users WHERE id = $1 AND deleted_at IS NULL)
+	`
+
+	var exists bool
+	r.log.Info("database query", slog.String("query", postgresql.FormatQuery(query)))
+	err := tx.QueryRow(ctx, query, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return ErrVersionMismatch
+	}
+
+	return ErrNotFound
+}
@@ -0,0 +1,85 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/romanchechyotkin/effective-mobile-test-task/internal/jobs"
+	"github.com/romanchechyotkin/effective-mobile-test-task/pkg/logger"
+)
+
+const (
+	reEnrichBatchSize = 50
+	// maxReEnrichAttempts is how many re-enrichments in a row may change nothing before
+	// a pending or low confidence user is left alone until it is stale.
+	maxReEnrichAttempts = 8
+)
+
+type schedulerConfig struct {
+	interval             time.Duration
+	pendingAfter         time.Duration
+	staleAfter           time.Duration
+	lowConfidenceAfter   time.Duration
+	minGenderProbability float32
+}
+
+func NewSchedulerConfig(interval, pendingAfter, staleAfter, lowConfidenceAfter time.Duration, minGenderProbability float32) *schedulerConfig {
+	return &schedulerConfig{
+		interval:             interval,
+		pendingAfter:         pendingAfter,
+		staleAfter:           staleAfter,
+		lowConfidenceAfter:   lowConfidenceAfter,
+		minGenderProbability: minGenderProbability,
+	}
+}
+
+// RunScheduler periodically enqueues re-enrichment jobs for pending, stale and low confidence users
+// and removes expired idempotency keys. It blocks until ctx is cancelled. Every instance may run it,
+// duplicate jobs are rejected by the queue.
+func RunScheduler(ctx context.Context, logger *slog.Logger, pool *pgxpool.Pool, queue jobs.Queue, cfg *schedulerConfig) {
+	repo := newRepository(logger, pool)
+
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scheduleReEnrichment(ctx, logger, repo, queue, cfg)
+			deleteExpiredIdempotencyKeys(ctx, logger, repo)
+		}
+	}
+}
+
+func scheduleReEnrichment(ctx context.Context, log *slog.Logger, repo storage, queue jobs.Queue, cfg *schedulerConfig) {
+	ids, err := repo.getUsersToReEnrich(ctx, cfg, reEnrichBatchSize)
+	if err != nil {
+		logger.Error(log, "error during getting users to re-enrich", err)
+		return
+	}
+	log.Debug("got users to re-enrich", slog.Int("count", len(ids)))
+
+	for _, id := range ids {
+		_, err = queue.Enqueue(ctx, JobReEnrich, id, reEnrichPayload{UserID: id})
+		if err != nil && !errors.Is(err, jobs.ErrDuplicate) {
+			logger.Error(log, "error during enqueueing re-enrichment", err)
+		}
+	}
+}
+
+func deleteExpiredIdempotencyKeys(ctx context.Context, log *slog.Logger, repo storage) {
+	deleted, err := repo.deleteExpiredIdempotencyKeys(ctx)
+	if err != nil {
+		logger.Error(log, "error during deleting expired idempotency keys", err)
+		return
+	}
+	if deleted != 0 {
+		log.Debug("expired idempotency keys deleted", slog.Int64("count", deleted))
+	}
+}
@@ -0,0 +1,246 @@
+package users
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// timestampLayout matches the text representation of timestamp without time zone columns.
+const timestampLayout = "2006-01-02T15:04:05.999999"
+
+// sortColumn is a users column listings can be ordered by. value extracts the text
+// representation of the column from a row, it is used to build keyset cursors.
+type sortColumn struct {
+	name    string
+	sqlType string
+	value   func(dto *UserResponseDto) *string
+}
+
+var idColumn = sortColumn{
+	name:    "id",
+	sqlType: "integer",
+	value: func(dto *UserResponseDto) *string {
+		return &dto.ID
+	},
+}
+
+func textColumn(name string, value func(dto *UserResponseDto) *string) sortColumn {
+	return sortColumn{
+		name:    name,
+		sqlType: "text",
+		value:   value,
+	}
+}
+
+// sortColumns is the whitelist of columns accepted by the sort query parameter.
+var sortColumns = map[string]sortColumn{
+	"id": idColumn,
+	"last_name": textColumn("last_name", func(dto *UserResponseDto) *string {
+		return &dto.LastName
+	}),
+	"first_name": textColumn("first_name", func(dto *UserResponseDto) *string {
+		return &dto.FirstName
+	}),
+	"second_name": textColumn("second_name", func(dto *UserResponseDto) *string {
+		return &dto.SecondName
+	}),
+	"gender": {
+		name:    "gender",
+		sqlType: "public.gender",
+		value: func(dto *UserResponseDto) *string {
+			return dto.Gender
+		},
+	},
+	"nationality": textColumn("nationality", func(dto *UserResponseDto) *string {
+		return dto.Nationality
+	}),
+	"age": {
+		name:    "age",
+		sqlType: "integer",
+		value: func(dto *UserResponseDto) *string {
+			if dto.Age == nil {
+				return nil
+			}
+			val := strconv.Itoa(*dto.Age)
+			return &val
+		},
+	},
+	"created_at": {
+		name:    "created_at",
+		sqlType: "timestamp",
+		value: func(dto *UserResponseDto) *string {
+			if dto.CreatedAt == nil {
+				return nil
+			}
+			val := dto.CreatedAt.Format(timestampLayout)
+			return &val
+		},
+	},
+}
+
+type sortKey struct {
+	column     sortColumn
+	desc       bool
+	nullsFirst bool
+}
+
+// sortOrder always contains the id key, so that the order is total and keyset pagination is stable.
+type sortOrder []sortKey
+
+const maxSortKeys = 5
+
+// legacySorts keeps the sort values supported before the sort grammar was introduced.
+var legacySorts = map[string]string{
+	"age.a": "age",
+	"age.d": "-age",
+}
+
+// parseSort parses a comma separated list of columns, a leading minus means descending order,
+// e.g. "nationality,-age,last_name". Creation order is the default. The id key is appended
+// unless it is already present, so that the order is total.
+func parseSort(sort string) (sortOrder, error) {
+	if legacy, ok := legacySorts[sort]; ok {
+		sort = legacy
+	}
+	if sort == "" {
+		sort = "created_at"
+	}
+
+	fields := strings.Split(sort, ",")
+	if len(fields) > maxSortKeys {
+		return nil, fmt.Errorf("sort accepts at most %d columns", maxSortKeys)
+	}
+
+	var order sortOrder
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+
+		desc := strings.HasPrefix(field, "-")
+		name := strings.TrimPrefix(strings.TrimPrefix(field, "-"), "+")
+
+		column, ok := sortColumns[name]
+		if !ok {
+			return nil, fmt.Errorf("can not sort by %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("column %q is repeated in sort", name)
+		}
+		seen[name] = true
+
+		order = append(order, sortKey{column: column, desc: desc})
+	}
+
+	if !seen[idColumn.name] {
+		order = append(order, sortKey{column: idColumn})
+	}
+
+	return order, nil
+}
+
+// String is a canonical representation used to bind cursors to the order they were made for.
+func (o sortOrder) String() string {
+	keys := make([]string, len(o))
+	for i, k := range o {
+		keys[i] = k.column.name
+		if k.desc {
+			keys[i] = "-" + keys[i]
+		}
+	}
+
+	return strings.Join(keys, ",")
+}
+
+// reversed returns the opposite order, used to walk pages backwards.
+func (o sortOrder) reversed() sortOrder {
+	res := make(sortOrder, len(o))
+	for i, k := range o {
+		res[i] = sortKey{column: k.column, desc: !k.desc, nullsFirst: !k.nullsFirst}
+	}
+
+	return res
+}
+
+func (o sortOrder) orderBy() string {
+	keys := make([]string, len(o))
+	for i, k := range o {
+		keys[i] = k.column.name
+		if k.desc {
+			keys[i] += " DESC"
+		}
+		if k.nullsFirst {
+			keys[i] += " NULLS FIRST"
+		} else {
+			keys[i] += " NULLS LAST"
+		}
+	}
+
+	return strings.Join(keys, ", ")
+}
+
+// values returns the keyset of the row.
+func (o sortOrder) values(dto *UserResponseDto) []*string {
+	res := make([]*string, len(o))
+	for i, k := range o {
+		res[i] = k.column.value(dto)
+	}
+
+	return res
+}
+
+// after renders a condition matching rows that come strictly after the keyset in this order.
+func (o sortOrder) after(values []*string, args *queryArgs) string {
+	var alternatives []string
+
+	for i, k := range o {
+		conds := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			conds = append(conds, o[j].equal(values[j], args))
+		}
+
+		after := k.after(values[i], args)
+		if after == "" {
+			continue
+		}
+		conds = append(conds, after)
+
+		alternatives = append(alternatives, "("+strings.Join(conds, " AND ")+")")
+	}
+
+	if len(alternatives) == 0 {
+		return "FALSE"
+	}
+
+	return "(" + strings.Join(alternatives, " OR ") + ")"
+}
+
+func (k sortKey) equal(value *string, args *queryArgs) string {
+	if value == nil {
+		return k.column.name + " IS NULL"
+	}
+
+	return k.column.name + " = " + args.add(*value) + "::" + k.column.sqlType
+}
+
+// after renders a condition for the single key, empty string means no row can be after.
+func (k sortKey) after(value *string, args *queryArgs) string {
+	if value == nil {
+		if k.nullsFirst {
+			return k.column.name + " IS NOT NULL"
+		}
+		return ""
+	}
+
+	op := " > "
+	if k.desc {
+		op = " < "
+	}
+
+	cond := k.column.name + op + args.add(*value) + "::" + k.column.sqlType
+	if k.nullsFirst {
+		return cond
+	}
+
+	return "(" + cond + " OR " + k.column.name + " IS NULL)"
+}
@@ -0,0 +1,69 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	GenderMale   = "male"
+	GenderFemale = "female"
+)
+
+const (
+	minAge = 0
+	maxAge = 150
+)
+
+// countryCodes is the set of ISO 3166-1 alpha-2 codes.
+var countryCodes = func() map[string]struct{} {
+	codes := strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS
+		BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE
+		EG EH ER ES ET FI FJ FK FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM
+		HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN KP KR KW KY KZ LA LB LC
+		LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ NA
+		NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW
+		SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO
+		TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW
+	`)
+
+	set := make(map[string]struct{}, len(codes))
+	for _, code := range codes {
+		set[code] = struct{}{}
+	}
+
+	return set
+}()
+
+func validateName(field, name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("%s must not be empty", field)
+	}
+
+	return nil
+}
+
+func validateAge(age int) error {
+	if age < minAge || age > maxAge {
+		return fmt.Errorf("age must be between %d and %d, got %d", minAge, maxAge, age)
+	}
+
+	return nil
+}
+
+func validateGender(gender string) error {
+	if gender != GenderMale && gender != GenderFemale {
+		return fmt.Errorf("gender must be %q or %q, got %q", GenderMale, GenderFemale, gender)
+	}
+
+	return nil
+}
+
+func validateNationality(code string) error {
+	if _, ok := countryCodes[code]; !ok {
+		return fmt.Errorf("nationality must be an ISO 3166-1 alpha-2 country code, got %q", code)
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+// Package names builds comparison keys for personal names entered in Cyrillic
+// or in one of the Latin transliterations.
+package names
+
+import (
+	"strings"
+)
+
+// Translit is the lowercase ICAO transliteration of name with everything but Latin letters removed,
+// e.g. "Александрович" and "Aleksandrovich" give "aleksandrovich".
+func Translit(name string) string {
+	latin := Transliterate(strings.ToLower(strings.TrimSpace(name)), ICAO)
+
+	var b strings.Builder
+	b.Grow(len(latin))
+	for _, r := range latin {
+		if r >= 'a' && r <= 'z' {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// phoneticReplacements unify spellings of the same sound in different transliteration
+// schemes. Upper case letters stand for single sounds spelled with several Latin letters.
+var phoneticReplacements = strings.NewReplacer(
+	"shch", "S", "sch", "S", "shh", "S", "sh", "S",
+	"tch", "C", "ch", "C",
+	"zh", "Z",
+	"kh", "h",
+	"tz", "T", "ts", "T", "cz", "T",
+	"x", "ks",
+	"ck", "k", "q", "k", "c", "k",
+	"ph", "f", "w", "v", "ff", "v", "f", "v",
+	"j", "y",
+)
+
+// Phonetic is a simplified Russian oriented phonetic key of name. Transliteration variants
+// of the same name share the key: "Alexandrovich", "Aleksandrovich" and "Александрович",
+// as well as "Chechyotkin", "Chechetkin" and "Чечёткин".
+//
+// The key keeps consonants only, a leading vowel is kept as "A", so that "Yuriy", "Iurii"
+// and "Юрий" match, repeated letters are collapsed.
+func Phonetic(name string) string {
+	s := phoneticReplacements.Replace(Translit(name))
+	if s == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	runes := []rune(s)
+	// "Yelena" and "Elena", "Yuriy" and "Iurii"
+	if len(runes) > 1 && runes[0] == 'y' && isVowel(runes[1]) {
+		runes = runes[1:]
+	}
+
+	var prev rune
+	for i, r := range runes {
+		if isVowel(r) {
+			if i == 0 {
+				b.WriteRune('A')
+			}
+			prev = 0
+			continue
+		}
+
+		if r != prev {
+			b.WriteRune(r)
+		}
+		prev = r
+	}
+
+	return b.String()
+}
+
+func isVowel(r rune) bool {
+	switch r {
+	case 'a', 'e', 'i', 'o', 'u', 'y':
+		return true
+	}
+
+	return false
+}
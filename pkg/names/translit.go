@@ -0,0 +1,87 @@
+package names
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Scheme maps lowercase Cyrillic letters to their Latin transliteration.
+type Scheme struct {
+	name    string
+	letters map[rune]string
+}
+
+func (s Scheme) String() string {
+	return s.name
+}
+
+// ICAO is the ICAO Doc 9303 scheme used in Russian and Ukrainian passports.
+var ICAO = Scheme{
+	name: "icao",
+	letters: map[rune]string{
+		'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+		'з': "z", 'и': "i", 'й': "i", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+		'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+		'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "ie", 'ы': "y", 'ь': "", 'э': "e", 'ю': "iu",
+		'я': "ia", 'і': "i", 'ї': "i", 'є': "ie", 'ґ': "g", 'ў': "u",
+	},
+}
+
+// GOST is the GOST 7.79-2000 system B scheme without diacritics, apostrophes are dropped
+// so that the result can be used in URLs and names.
+var GOST = Scheme{
+	name: "gost",
+	letters: map[rune]string{
+		'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+		'з': "z", 'и': "i", 'й': "j", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+		'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "x", 'ц': "cz",
+		'ч': "ch", 'ш': "sh", 'щ': "shh", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+		'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ў': "u",
+	},
+}
+
+// ParseScheme returns the scheme by its name, empty name means ICAO.
+func ParseScheme(name string) (Scheme, error) {
+	switch strings.ToLower(name) {
+	case "", ICAO.name:
+		return ICAO, nil
+	case GOST.name:
+		return GOST, nil
+	default:
+		return Scheme{}, fmt.Errorf("unknown transliteration scheme %q", name)
+	}
+}
+
+// Transliterate replaces Cyrillic letters with Latin ones, other characters are kept.
+// Capitalization of the first letter of a transliterated digraph is preserved.
+func Transliterate(s string, scheme Scheme) string {
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for _, r := range s {
+		latin, ok := scheme.letters[unicode.ToLower(r)]
+		if !ok {
+			b.WriteRune(r)
+			continue
+		}
+
+		if unicode.IsUpper(r) && latin != "" {
+			latin = strings.ToUpper(latin[:1]) + latin[1:]
+		}
+		b.WriteString(latin)
+	}
+
+	return b.String()
+}
+
+// HasCyrillic reports whether s contains at least one Cyrillic letter.
+func HasCyrillic(s string) bool {
+	for _, r := range s {
+		if unicode.Is(unicode.Cyrillic, r) {
+			return true
+		}
+	}
+
+	return false
+}
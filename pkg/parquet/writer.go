@@ -0,0 +1,370 @@
+// Package parquet writes flat Apache Parquet files. Values are stored in plain encoding
+// without compression, one data page per column of a row group.
+package parquet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Type is the type of column values.
+type Type int
+
+const (
+	// String is a UTF-8 string.
+	String Type = iota
+	Int32
+	Int64
+	// Timestamp is a UTC timestamp with microsecond precision.
+	Timestamp
+)
+
+// Physical types, converted types, encodings and repetition types of the parquet format.
+const (
+	typeInt32     = 1
+	typeInt64     = 2
+	typeByteArray = 6
+
+	convertedUTF8            = 0
+	convertedTimestampMicros = 10
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	pageData = 0
+)
+
+var magic = []byte("PAR1")
+
+// Column describes a column of the file, only optional columns take nil values.
+type Column struct {
+	Name     string
+	Type     Type
+	Optional bool
+}
+
+func (c *Column) physicalType() int32 {
+	switch c.Type {
+	case Int32:
+		return typeInt32
+	case Int64, Timestamp:
+		return typeInt64
+	default:
+		return typeByteArray
+	}
+}
+
+type columnChunk struct {
+	values []byte
+	// levels are the definition levels of optional columns, 0 for null and 1 for a value.
+	levels []byte
+}
+
+type columnMeta struct {
+	offset int64
+	size   int64
+}
+
+type rowGroup struct {
+	columns []columnMeta
+	rows    int64
+}
+
+// Writer buffers rows of a row group in memory and writes them out when the group is full,
+// the metadata is written by Close.
+type Writer struct {
+	w            io.Writer
+	columns      []Column
+	rowGroupSize int
+
+	chunks    []columnChunk
+	rows      int
+	rowGroups []rowGroup
+	offset    int64
+	err       error
+}
+
+// NewWriter returns a writer of files with the given columns, rowGroupSize rows are kept in memory at most.
+func NewWriter(w io.Writer, columns []Column, rowGroupSize int) *Writer {
+	return &Writer{
+		w:            w,
+		columns:      columns,
+		rowGroupSize: rowGroupSize,
+		chunks:       make([]columnChunk, len(columns)),
+	}
+}
+
+// Write appends a row, values are given in the order of the columns. String columns take string,
+// Int32 and Int64 columns take int, int32 or int64 and Timestamp columns take time.Time values.
+func (p *Writer) Write(values ...any) error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(values) != len(p.columns) {
+		return fmt.Errorf("parquet: row has %d values, want %d", len(values), len(p.columns))
+	}
+
+	// values are checked first, so a bad row does not leave columns of different length
+	for i, v := range values {
+		if err := p.columns[i].check(v); err != nil {
+			return err
+		}
+	}
+
+	for i, v := range values {
+		chunk := &p.chunks[i]
+		if p.columns[i].Optional {
+			if v == nil {
+				chunk.levels = append(chunk.levels, 0)
+				continue
+			}
+			chunk.levels = append(chunk.levels, 1)
+		}
+		chunk.values = appendValue(chunk.values, p.columns[i].Type, v)
+	}
+
+	p.rows++
+	if p.rows >= p.rowGroupSize {
+		p.err = p.flush()
+	}
+
+	return p.err
+}
+
+// Close writes the buffered rows and the metadata, it does not close the underlying writer.
+func (p *Writer) Close() error {
+	if p.err != nil {
+		return p.err
+	}
+
+	if p.rows != 0 || p.offset == 0 {
+		p.err = p.flush()
+		if p.err != nil {
+			return p.err
+		}
+	}
+
+	footer := p.footer()
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(footer)))
+	footer = append(footer, magic...)
+
+	p.err = p.write(footer)
+	if p.err == nil {
+		p.err = errors.New("parquet: writer is closed")
+		return nil
+	}
+
+	return p.err
+}
+
+func (c *Column) check(v any) error {
+	if v == nil {
+		if !c.Optional {
+			return fmt.Errorf("parquet: column %s is required", c.Name)
+		}
+		return nil
+	}
+
+	var ok bool
+	switch c.Type {
+	case String:
+		_, ok = v.(string)
+	case Int32, Int64:
+		switch v.(type) {
+		case int, int32, int64:
+			ok = true
+		}
+	case Timestamp:
+		_, ok = v.(time.Time)
+	}
+	if !ok {
+		return fmt.Errorf("parquet: column %s can not take %T", c.Name, v)
+	}
+
+	return nil
+}
+
+// appendValue appends v in plain encoding, v has to be checked against the column type.
+func appendValue(buf []byte, typ Type, v any) []byte {
+	var n int64
+	switch v := v.(type) {
+	case string:
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(v)))
+		return append(buf, v...)
+	case time.Time:
+		n = v.UnixMicro()
+	case int:
+		n = int64(v)
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	}
+
+	if typ == Int32 {
+		return binary.LittleEndian.AppendUint32(buf, uint32(n))
+	}
+
+	return binary.LittleEndian.AppendUint64(buf, uint64(n))
+}
+
+// flush writes the buffered rows as a row group, the first flush writes the file header too.
+func (p *Writer) flush() error {
+	if p.offset == 0 {
+		if err := p.write(magic); err != nil {
+			return err
+		}
+	}
+	if p.rows == 0 {
+		return nil
+	}
+
+	group := rowGroup{
+		columns: make([]columnMeta, len(p.columns)),
+		rows:    int64(p.rows),
+	}
+	for i := range p.columns {
+		var data []byte
+		if p.columns[i].Optional {
+			levels := appendLevels(nil, p.chunks[i].levels)
+			data = binary.LittleEndian.AppendUint32(data, uint32(len(levels)))
+			data = append(data, levels...)
+		}
+		data = append(data, p.chunks[i].values...)
+
+		header := pageHeader(len(data), p.rows)
+
+		group.columns[i] = columnMeta{
+			offset: p.offset,
+			size:   int64(len(header) + len(data)),
+		}
+		if err := p.write(header); err != nil {
+			return err
+		}
+		if err := p.write(data); err != nil {
+			return err
+		}
+
+		p.chunks[i] = columnChunk{
+			values: p.chunks[i].values[:0],
+			levels: p.chunks[i].levels[:0],
+		}
+	}
+
+	p.rowGroups = append(p.rowGroups, group)
+	p.rows = 0
+
+	return nil
+}
+
+func (p *Writer) write(b []byte) error {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	return err
+}
+
+// appendLevels encodes definition levels of bit width 1 as runs of the RLE/bit-packing hybrid encoding.
+func appendLevels(buf, levels []byte) []byte {
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		buf = binary.AppendUvarint(buf, uint64(j-i)<<1)
+		buf = append(buf, levels[i])
+		i = j
+	}
+
+	return buf
+}
+
+func pageHeader(size, values int) []byte {
+	var t thriftWriter
+	t.beginStruct()
+	t.i32(1, pageData)
+	t.i32(2, int32(size))
+	t.i32(3, int32(size))
+	t.structField(5)
+	t.i32(1, int32(values))
+	t.i32(2, encodingPlain)
+	t.i32(3, encodingRLE)
+	t.i32(4, encodingRLE)
+	t.endStruct()
+	t.endStruct()
+
+	return t.buf
+}
+
+func (p *Writer) footer() []byte {
+	var t thriftWriter
+	t.beginStruct()
+	t.i32(1, 1)
+
+	t.list(2, thriftStruct, len(p.columns)+1)
+	t.beginStruct()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(p.columns)))
+	t.endStruct()
+	for _, c := range p.columns {
+		t.beginStruct()
+		t.i32(1, c.physicalType())
+		repetition := int32(repetitionRequired)
+		if c.Optional {
+			repetition = repetitionOptional
+		}
+		t.i32(3, repetition)
+		t.binary(4, c.Name)
+		switch c.Type {
+		case String:
+			t.i32(6, convertedUTF8)
+		case Timestamp:
+			t.i32(6, convertedTimestampMicros)
+		}
+		t.endStruct()
+	}
+
+	var rows int64
+	for _, g := range p.rowGroups {
+		rows += g.rows
+	}
+	t.i64(3, rows)
+
+	t.list(4, thriftStruct, len(p.rowGroups))
+	for _, g := range p.rowGroups {
+		t.beginStruct()
+		t.list(1, thriftStruct, len(g.columns))
+		var total int64
+		for i, c := range g.columns {
+			total += c.size
+			t.beginStruct()
+			t.i64(2, c.offset)
+			t.structField(3)
+			t.i32(1, p.columns[i].physicalType())
+			t.list(2, thriftI32, 2)
+			t.listI32(encodingPlain)
+			t.listI32(encodingRLE)
+			t.list(3, thriftBinary, 1)
+			t.listBinary(p.columns[i].Name)
+			t.i32(4, 0)
+			t.i64(5, g.rows)
+			t.i64(6, c.size)
+			t.i64(7, c.size)
+			t.i64(9, c.offset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.i64(2, total)
+		t.i64(3, g.rows)
+		t.endStruct()
+	}
+
+	t.endStruct()
+
+	return t.buf
+}
@@ -0,0 +1,389 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+var testColumns = []Column{
+	{Name: "id", Type: Int64},
+	{Name: "name", Type: String},
+	{Name: "age", Type: Int32, Optional: true},
+	{Name: "gender", Type: String, Optional: true},
+	{Name: "created_at", Type: Timestamp},
+}
+
+func TestWriterRowGroups(t *testing.T) {
+	created := time.Date(2023, 10, 22, 14, 46, 54, 958413000, time.UTC)
+	rows := [][]any{
+		{1, "Roman", 55, "male", created},
+		{2, "Olga", nil, "female", created.Add(time.Hour)},
+		{int64(3), "Лёша", int32(45), nil, created.Add(2 * time.Hour)},
+		{4, "", nil, nil, created.Add(3 * time.Hour)},
+		{5, "Anna", 51, "female", created.Add(4 * time.Hour)},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, testColumns, 2)
+	for _, row := range rows {
+		if err := w.Write(row...); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	file := readFile(t, buf.Bytes())
+	if file.rowGroups != 3 {
+		t.Errorf("row groups = %d, want 3", file.rowGroups)
+	}
+
+	want := [][]any{
+		{int64(1), "Roman", int32(55), "male", created.UnixMicro()},
+		{int64(2), "Olga", nil, "female", created.Add(time.Hour).UnixMicro()},
+		{int64(3), "Лёша", int32(45), nil, created.Add(2 * time.Hour).UnixMicro()},
+		{int64(4), "", nil, nil, created.Add(3 * time.Hour).UnixMicro()},
+		{int64(5), "Anna", int32(51), "female", created.Add(4 * time.Hour).UnixMicro()},
+	}
+	if len(file.rows) != len(want) {
+		t.Fatalf("rows = %d, want %d", len(file.rows), len(want))
+	}
+	for n, row := range want {
+		for i, v := range row {
+			if file.rows[n][i] != v {
+				t.Errorf("row %d column %s = %#v, want %#v", n, testColumns[i].Name, file.rows[n][i], v)
+			}
+		}
+	}
+}
+
+func TestWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, testColumns, 2)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	file := readFile(t, buf.Bytes())
+	if file.rowGroups != 0 || len(file.rows) != 0 {
+		t.Errorf("file has %d row groups and %d rows, want none", file.rowGroups, len(file.rows))
+	}
+}
+
+func TestWriterRejectsBadRows(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, testColumns, 2)
+	if err := w.Write(1, nil, 1, "male", time.Now()); err == nil {
+		t.Error("null in a required column is written")
+	}
+	if err := w.Write(1, "Roman", "55", "male", time.Now()); err == nil {
+		t.Error("string in an integer column is written")
+	}
+	if err := w.Write(1, "Roman"); err == nil {
+		t.Error("short row is written")
+	}
+
+	// rejected rows leave nothing behind
+	if err := w.Write(1, "Roman", nil, nil, time.Now()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if file := readFile(t, buf.Bytes()); len(file.rows) != 1 {
+		t.Errorf("rows = %d, want 1", len(file.rows))
+	}
+}
+
+// parquetFile is what readFile decodes, values of the rows are int32, int64, string or nil.
+type parquetFile struct {
+	rowGroups int
+	rows      [][]any
+}
+
+// readFile decodes data following the parquet format specification, independently of the writer.
+// Besides the values it checks the schema against testColumns and the sizes and offsets of the metadata.
+func readFile(t *testing.T, data []byte) *parquetFile {
+	t.Helper()
+
+	if len(data) < 12 || string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		t.Fatalf("file is not framed by PAR1")
+	}
+	footerSize := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footerStart := len(data) - 8 - footerSize
+	if footerStart < 4 {
+		t.Fatalf("footer size %d exceeds the file", footerSize)
+	}
+
+	r := &thriftReader{t: t, buf: data[footerStart : len(data)-8]}
+	meta := r.readStruct()
+	if r.pos != len(r.buf) {
+		t.Fatalf("footer has %d trailing bytes", len(r.buf)-r.pos)
+	}
+
+	schema := meta[2].([]any)
+	if len(schema) != len(testColumns)+1 || schema[0].(map[int16]any)[5] != int32(len(testColumns)) {
+		t.Fatalf("schema root does not have the %d columns", len(testColumns))
+	}
+	for i, c := range testColumns {
+		el := schema[i+1].(map[int16]any)
+		repetition := int32(repetitionRequired)
+		if c.Optional {
+			repetition = repetitionOptional
+		}
+		if string(el[4].([]byte)) != c.Name || el[1] != c.physicalType() || el[3] != repetition {
+			t.Errorf("schema element %d = %v, does not describe column %s", i+1, el, c.Name)
+		}
+		switch c.Type {
+		case String:
+			checkField(t, el, 6, int32(convertedUTF8))
+		case Timestamp:
+			checkField(t, el, 6, int32(convertedTimestampMicros))
+		default:
+			if _, ok := el[6]; ok {
+				t.Errorf("column %s has a converted type", c.Name)
+			}
+		}
+	}
+
+	file := &parquetFile{}
+	groups, _ := meta[4].([]any)
+	file.rowGroups = len(groups)
+	for _, g := range groups {
+		group := g.(map[int16]any)
+		rows := int(group[3].(int64))
+		chunks := group[1].([]any)
+		if len(chunks) != len(testColumns) {
+			t.Fatalf("row group has %d columns, want %d", len(chunks), len(testColumns))
+		}
+
+		columns := make([][]any, len(chunks))
+		var total int64
+		for i, c := range chunks {
+			chunk := c.(map[int16]any)
+			columnMeta := chunk[3].(map[int16]any)
+			checkField(t, columnMeta, 4, int32(0))
+			checkField(t, columnMeta, 5, int64(rows))
+			if string(columnMeta[3].([]any)[0].([]byte)) != testColumns[i].Name {
+				t.Errorf("chunk %d has path %v", i, columnMeta[3])
+			}
+
+			offset := columnMeta[9].(int64)
+			size := columnMeta[7].(int64)
+			total += size
+			if chunk[2] != offset || offset < 4 || offset+size > int64(footerStart) {
+				t.Fatalf("chunk %d at %d of %d bytes is not within the data", i, offset, size)
+			}
+			columns[i] = readPage(t, data[offset:offset+size], testColumns[i], rows)
+		}
+		checkField(t, group, 2, total)
+
+		for n := 0; n < rows; n++ {
+			row := make([]any, len(columns))
+			for i := range columns {
+				row[i] = columns[i][n]
+			}
+			file.rows = append(file.rows, row)
+		}
+	}
+	checkField(t, meta, 3, int64(len(file.rows)))
+
+	return file
+}
+
+// readPage decodes a column chunk made of a single uncompressed data page.
+func readPage(t *testing.T, chunk []byte, c Column, rows int) []any {
+	t.Helper()
+
+	r := &thriftReader{t: t, buf: chunk}
+	header := r.readStruct()
+	checkField(t, header, 1, int32(pageData))
+	checkField(t, header, 2, int32(len(chunk)-r.pos))
+	checkField(t, header, 3, int32(len(chunk)-r.pos))
+	dataHeader := header[5].(map[int16]any)
+	checkField(t, dataHeader, 1, int32(rows))
+	checkField(t, dataHeader, 2, int32(encodingPlain))
+
+	page := chunk[r.pos:]
+	defined := make([]bool, rows)
+	for n := range defined {
+		defined[n] = true
+	}
+	if c.Optional {
+		size := int(binary.LittleEndian.Uint32(page))
+		defined = readLevels(t, page[4:4+size], rows)
+		page = page[4+size:]
+	}
+
+	values := make([]any, rows)
+	for n := range values {
+		if !defined[n] {
+			continue
+		}
+		switch c.physicalType() {
+		case typeInt32:
+			values[n] = int32(binary.LittleEndian.Uint32(page))
+			page = page[4:]
+		case typeInt64:
+			values[n] = int64(binary.LittleEndian.Uint64(page))
+			page = page[8:]
+		default:
+			size := int(binary.LittleEndian.Uint32(page))
+			values[n] = string(page[4 : 4+size])
+			page = page[4+size:]
+		}
+	}
+	if len(page) != 0 {
+		t.Errorf("page of column %s has %d trailing bytes", c.Name, len(page))
+	}
+
+	return values
+}
+
+// readLevels decodes definition levels of bit width 1 in the RLE/bit-packing hybrid encoding.
+func readLevels(t *testing.T, buf []byte, count int) []bool {
+	t.Helper()
+
+	var levels []bool
+	for len(buf) != 0 {
+		header, n := binary.Uvarint(buf)
+		buf = buf[n:]
+		if header&1 == 0 {
+			for i := uint64(0); i < header>>1; i++ {
+				levels = append(levels, buf[0] == 1)
+			}
+			buf = buf[1:]
+			continue
+		}
+
+		groups := int(header >> 1)
+		for _, b := range buf[:groups] {
+			for bit := 0; bit < 8; bit++ {
+				levels = append(levels, b>>bit&1 == 1)
+			}
+		}
+		buf = buf[groups:]
+	}
+	if len(levels) < count {
+		t.Fatalf("%d definition levels, want %d", len(levels), count)
+	}
+
+	return levels[:count]
+}
+
+func checkField(t *testing.T, s map[int16]any, id int16, want any) {
+	t.Helper()
+
+	if s[id] != want {
+		t.Errorf("field %d = %#v, want %#v", id, s[id], want)
+	}
+}
+
+// thriftReader decodes the thrift compact protocol. Structs become maps of field ids,
+// lists and sets become slices and binaries stay byte slices.
+type thriftReader struct {
+	t   *testing.T
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) next() byte {
+	if r.pos >= len(r.buf) {
+		r.t.Fatalf("thrift data ends at %d", r.pos)
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	var v uint64
+	for shift := 0; ; shift += 7 {
+		b := r.next()
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) readStruct() map[int16]any {
+	fields := make(map[int16]any)
+	var id int16
+	for {
+		b := r.next()
+		if b == 0 {
+			return fields
+		}
+
+		if delta := int16(b >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.zigzag())
+		}
+
+		typ := b & 0x0f
+		switch typ {
+		case 1, 2:
+			// booleans keep their value in the field type
+			fields[id] = typ == 1
+		default:
+			fields[id] = r.value(typ)
+		}
+	}
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case 1, 2:
+		return r.next() == 1
+	case 3:
+		return int8(r.next())
+	case 4:
+		return int16(r.zigzag())
+	case 5:
+		return int32(r.zigzag())
+	case 6:
+		return r.zigzag()
+	case 7:
+		if r.pos+8 > len(r.buf) {
+			r.t.Fatalf("thrift data ends at %d", r.pos)
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.buf[r.pos:]))
+		r.pos += 8
+		return v
+	case 8:
+		size := int(r.uvarint())
+		if r.pos+size > len(r.buf) {
+			r.t.Fatalf("thrift data ends at %d", r.pos)
+		}
+		v := r.buf[r.pos : r.pos+size]
+		r.pos += size
+		return v
+	case 9, 10:
+		b := r.next()
+		size := int(b >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		values := make([]any, size)
+		for i := range values {
+			values[i] = r.value(b & 0x0f)
+		}
+		return values
+	case 12:
+		return r.readStruct()
+	}
+
+	r.t.Fatalf("unsupported thrift type %d at %d", typ, r.pos)
+	return nil
+}
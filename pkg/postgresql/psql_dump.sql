@@ -16,6 +16,14 @@ SET xmloption = content;
 SET client_min_messages = warning;
 SET row_security = off;
 
+--
+-- Name: pg_trgm; Type: EXTENSION; Schema: -; Owner: -
+
+--
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm WITH SCHEMA public;
+
+
 --
 -- Name: gender; Type: TYPE; Schema: public; Owner: postgres
 
@@ -30,6 +38,36 @@ CREATE TYPE public.gender AS ENUM (
 ALTER TYPE public.gender OWNER TO postgres
 ;
 
+--
+-- Name: enrichment_status; Type: TYPE; Schema: public; Owner: postgres
+
+--
+
+CREATE TYPE public.enrichment_status AS ENUM (
+    'complete',
+    'pending_enrichment'
+);
+
+
+ALTER TYPE public.enrichment_status OWNER TO postgres
+;
+
+--
+-- Name: job_status; Type: TYPE; Schema: public; Owner: postgres
+
+--
+
+CREATE TYPE public.job_status AS ENUM (
+    'queued',
+    'running',
+    'done',
+    'failed'
+);
+
+
+ALTER TYPE public.job_status OWNER TO postgres
+;
+
 SET default_tablespace = '';
 
 SET default_table_access_method = heap;
@@ -44,16 +82,359 @@ CREATE TABLE public.users (
     last_name text NOT NULL,
     first_name text NOT NULL,
     second_name text,
-    age integer NOT NULL,
-    gender public.gender NOT NULL,
-    nationality text NOT NULL,
-    created_at timestamp without time zone DEFAULT now()
+    age integer,
+    gender public.gender,
+    nationality text,
+    created_at timestamp without time zone DEFAULT now(),
+    enrichment_status public.enrichment_status DEFAULT 'complete'::public.enrichment_status NOT NULL,
+    gender_probability real,
+    enriched_at timestamp with time zone,
+    age_count integer,
+    version integer DEFAULT 1 NOT NULL,
+    full_name text GENERATED ALWAYS AS (((((last_name || ' '::text) || first_name) || ' '::text) || COALESCE(second_name, ''::text))) STORED,
+    last_name_translit text,
+    first_name_translit text,
+    second_name_translit text,
+    last_name_phonetic text,
+    first_name_phonetic text,
+    second_name_phonetic text,
+    enrichment_key text,
+    deleted_at timestamp with time zone,
+    enrichment_attempts integer DEFAULT 0 NOT NULL,
+    full_name_translit text GENERATED ALWAYS AS (((((COALESCE(last_name_translit, ''::text) || ' '::text) || COALESCE(first_name_translit, ''::text)) || ' '::text) || COALESCE(second_name_translit, ''::text))) STORED
 );
 
 
 ALTER TABLE public.users OWNER TO postgres
 ;
 
+--
+-- Name: enrichment_cache; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.enrichment_cache (
+    name text NOT NULL,
+    age integer NOT NULL,
+    age_count integer NOT NULL,
+    gender text NOT NULL,
+    gender_probability real NOT NULL,
+    gender_count integer NOT NULL,
+    countries jsonb DEFAULT '[]'::jsonb NOT NULL,
+    nationality_count integer NOT NULL,
+    unknown text[] DEFAULT '{}'::text[] NOT NULL,
+    fetched_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.enrichment_cache OWNER TO postgres
+;
+
+--
+-- Name: jobs; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.jobs (
+    id bigint NOT NULL,
+    kind text NOT NULL,
+    key text,
+    payload jsonb DEFAULT '{}'::jsonb NOT NULL,
+    status public.job_status DEFAULT 'queued'::public.job_status NOT NULL,
+    attempts integer DEFAULT 0 NOT NULL,
+    error text,
+    result jsonb,
+    progress jsonb,
+    run_at timestamp with time zone DEFAULT now() NOT NULL,
+    locked_until timestamp with time zone,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.jobs OWNER TO postgres
+;
+
+--
+-- Name: jobs_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+
+--
+
+CREATE SEQUENCE public.jobs_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.jobs_id_seq OWNER TO postgres
+;
+
+--
+-- Name: jobs_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+
+--
+
+ALTER SEQUENCE public.jobs_id_seq OWNED BY public.jobs.id;
+
+
+--
+-- Name: jobs id; Type: DEFAULT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.jobs ALTER COLUMN id SET DEFAULT nextval('public.jobs_id_seq'::regclass);
+
+
+--
+-- Name: user_nationalities; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.user_nationalities (
+    user_id integer NOT NULL,
+    rank integer NOT NULL,
+    country_id text NOT NULL,
+    probability real NOT NULL
+);
+
+
+ALTER TABLE public.user_nationalities OWNER TO postgres
+;
+
+--
+-- Name: user_field_provenance; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.user_field_provenance (
+    user_id integer NOT NULL,
+    field text NOT NULL,
+    source text NOT NULL,
+    actor text NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.user_field_provenance OWNER TO postgres
+;
+
+--
+-- Name: user_merges; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.user_merges (
+    id bigint NOT NULL,
+    target_id integer NOT NULL,
+    source_id integer NOT NULL,
+    source jsonb NOT NULL,
+    changes jsonb DEFAULT '{}'::jsonb NOT NULL,
+    actor text NOT NULL,
+    merged_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.user_merges OWNER TO postgres
+;
+
+--
+-- Name: user_merges_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+
+--
+
+CREATE SEQUENCE public.user_merges_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.user_merges_id_seq OWNER TO postgres
+;
+
+--
+-- Name: user_merges_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+
+--
+
+ALTER SEQUENCE public.user_merges_id_seq OWNED BY public.user_merges.id;
+
+
+--
+-- Name: user_merges id; Type: DEFAULT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_merges ALTER COLUMN id SET DEFAULT nextval('public.user_merges_id_seq'::regclass);
+
+
+--
+-- Name: user_history; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.user_history (
+    id bigint NOT NULL,
+    user_id integer NOT NULL,
+    version integer NOT NULL,
+    operation text NOT NULL,
+    snapshot jsonb NOT NULL,
+    actor text NOT NULL,
+    request_id text,
+    changed_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.user_history OWNER TO postgres
+;
+
+--
+-- Name: user_history_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+
+--
+
+CREATE SEQUENCE public.user_history_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.user_history_id_seq OWNER TO postgres
+;
+
+--
+-- Name: user_history_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+
+--
+
+ALTER SEQUENCE public.user_history_id_seq OWNED BY public.user_history.id;
+
+
+--
+-- Name: user_history id; Type: DEFAULT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_history ALTER COLUMN id SET DEFAULT nextval('public.user_history_id_seq'::regclass);
+
+
+--
+-- Name: user_imports; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.user_imports (
+    id bigint NOT NULL,
+    format text NOT NULL,
+    actor text NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.user_imports OWNER TO postgres
+;
+
+--
+-- Name: user_import_chunks; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.user_import_chunks (
+    import_id bigint NOT NULL,
+    seq integer NOT NULL,
+    data bytea NOT NULL
+);
+
+
+ALTER TABLE public.user_import_chunks OWNER TO postgres
+;
+
+--
+-- Name: user_import_batches; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.user_import_batches (
+    import_id bigint NOT NULL,
+    seq integer NOT NULL,
+    rows jsonb NOT NULL
+);
+
+
+ALTER TABLE public.user_import_batches OWNER TO postgres
+;
+
+--
+-- Name: user_create_jobs; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.user_create_jobs (
+    job_id bigint NOT NULL,
+    user_id integer NOT NULL
+);
+
+
+ALTER TABLE public.user_create_jobs OWNER TO postgres
+;
+
+--
+-- Name: user_imports_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+
+--
+
+CREATE SEQUENCE public.user_imports_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.user_imports_id_seq OWNER TO postgres
+;
+
+--
+-- Name: user_imports_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+
+--
+
+ALTER SEQUENCE public.user_imports_id_seq OWNED BY public.user_imports.id;
+
+
+--
+-- Name: user_imports id; Type: DEFAULT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_imports ALTER COLUMN id SET DEFAULT nextval('public.user_imports_id_seq'::regclass);
+
+
+--
+-- Name: idempotency_keys; Type: TABLE; Schema: public; Owner: postgres
+
+--
+
+CREATE TABLE public.idempotency_keys (
+    key text NOT NULL,
+    request_hash text NOT NULL,
+    status_code integer,
+    headers jsonb,
+    body bytea,
+    locked_until timestamp with time zone,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    expires_at timestamp with time zone NOT NULL
+);
+
+
+ALTER TABLE public.idempotency_keys OWNER TO postgres
+;
+
 --
 -- Name: users_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 
@@ -92,12 +473,12 @@ ALTER TABLE ONLY public.users ALTER COLUMN id SET DEFAULT nextval('public.users_
 
 --
 
-COPY public.users (id, last_name, first_name, second_name, age, gender, nationality, created_at) FROM stdin;
-1	Chechyotkin	Roman	Alexandrovich	55	male	CZ	2023-10-22 14:46:54.958413
-3	Neronskiy	Lesha	Vyacheslavovich	45	female	BY	2023-10-22 15:03:10.375839
-6	Kozlova	Anna	Alexandrovna	51	female	PL	2023-10-22 17:56:55.775437
-2	Kostuk	Olga		55	female	UA	2023-10-22 14:47:36.907376
-5	asdasda	Nastya	germanovna	5	female	UA	2023-10-22 15:05:56.08489
+COPY public.users (id, last_name, first_name, second_name, age, gender, nationality, created_at, last_name_translit, first_name_translit, second_name_translit, last_name_phonetic, first_name_phonetic, second_name_phonetic) FROM stdin;
+1	Chechyotkin	Roman	Alexandrovich	55	male	CZ	2023-10-22 14:46:54.958413	chechyotkin	roman	alexandrovich	CCtkn	rmn	AlksndrvC
+3	Neronskiy	Lesha	Vyacheslavovich	45	female	BY	2023-10-22 15:03:10.375839	neronskiy	lesha	vyacheslavovich	nrnsk	lS	vCslvvC
+6	Kozlova	Anna	Alexandrovna	51	female	PL	2023-10-22 17:56:55.775437	kozlova	anna	alexandrovna	kzlv	An	Alksndrvn
+2	Kostuk	Olga		55	female	UA	2023-10-22 14:47:36.907376	kostuk	olga		kstk	Alg	
+5	asdasda	Nastya	germanovna	5	female	UA	2023-10-22 15:05:56.08489	asdasda	nastya	germanovna	Asdsd	nst	grmnvn
 \.
 
 
@@ -109,6 +490,30 @@ COPY public.users (id, last_name, first_name, second_name, age, gender, national
 SELECT pg_catalog.setval('public.users_id_seq', 6, true);
 
 
+--
+-- Data for Name: user_history; Type: TABLE DATA; Schema: public; Owner: postgres
+
+--
+
+INSERT INTO public.user_history (user_id, version, operation, snapshot, actor)
+SELECT id, version, 'create', jsonb_build_object(
+	'last_name', last_name,
+	'first_name', first_name,
+	'second_name', second_name,
+	'age', age,
+	'gender', gender,
+	'nationality', nationality,
+	'status', enrichment_status,
+	'deleted_at', deleted_at,
+	'provenance', (
+		SELECT jsonb_object_agg(p.field, jsonb_build_object('source', p.source, 'actor', p.actor, 'updated_at', p.updated_at))
+		FROM public.user_field_provenance p
+		WHERE p.user_id = users.id
+	)
+), 'system'
+FROM public.users;
+
+
 --
 -- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
 
@@ -118,6 +523,264 @@ ALTER TABLE ONLY public.users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: enrichment_cache enrichment_cache_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.enrichment_cache
+    ADD CONSTRAINT enrichment_cache_pkey PRIMARY KEY (name);
+
+
+--
+-- Name: user_history user_history_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_history
+    ADD CONSTRAINT user_history_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: user_history user_history_user_id_version_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_history
+    ADD CONSTRAINT user_history_user_id_version_key UNIQUE (user_id, version);
+
+
+--
+-- Name: user_imports user_imports_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_imports
+    ADD CONSTRAINT user_imports_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: user_import_chunks user_import_chunks_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_import_chunks
+    ADD CONSTRAINT user_import_chunks_pkey PRIMARY KEY (import_id, seq);
+
+
+--
+-- Name: user_import_batches user_import_batches_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_import_batches
+    ADD CONSTRAINT user_import_batches_pkey PRIMARY KEY (import_id, seq);
+
+
+--
+-- Name: user_create_jobs user_create_jobs_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_create_jobs
+    ADD CONSTRAINT user_create_jobs_pkey PRIMARY KEY (job_id);
+
+
+--
+-- Name: user_merges user_merges_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_merges
+    ADD CONSTRAINT user_merges_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: jobs jobs_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.jobs
+    ADD CONSTRAINT jobs_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: idempotency_keys idempotency_keys_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.idempotency_keys
+    ADD CONSTRAINT idempotency_keys_pkey PRIMARY KEY (key);
+
+
+--
+-- Name: idempotency_keys_expires_at_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX idempotency_keys_expires_at_idx ON public.idempotency_keys USING btree (expires_at);
+
+
+--
+-- Name: jobs_runnable_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX jobs_runnable_idx ON public.jobs USING btree (run_at) WHERE (status = ANY (ARRAY['queued'::public.job_status, 'running'::public.job_status]));
+
+
+--
+-- Name: jobs_unfinished_key_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE UNIQUE INDEX jobs_unfinished_key_idx ON public.jobs USING btree (kind, key) WHERE (status = ANY (ARRAY['queued'::public.job_status, 'running'::public.job_status]));
+
+
+--
+-- Name: user_nationalities user_nationalities_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_nationalities
+    ADD CONSTRAINT user_nationalities_pkey PRIMARY KEY (user_id, rank);
+
+
+--
+-- Name: users_age_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX users_age_idx ON public.users USING btree (age);
+
+
+--
+-- Name: users_created_at_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX users_created_at_idx ON public.users USING btree (created_at);
+
+
+--
+-- Name: users_nationality_gender_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX users_nationality_gender_idx ON public.users USING btree (nationality, gender);
+
+
+--
+-- Name: users_full_name_trgm_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX users_full_name_trgm_idx ON public.users USING gin (full_name public.gin_trgm_ops);
+
+
+--
+-- Name: users_full_name_translit_trgm_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX users_full_name_translit_trgm_idx ON public.users USING gin (full_name_translit public.gin_trgm_ops);
+
+
+--
+-- Name: users_name_translit_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX users_name_translit_idx ON public.users USING btree (last_name_translit, first_name_translit);
+
+
+--
+-- Name: users_last_name_phonetic_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX users_last_name_phonetic_idx ON public.users USING btree (last_name_phonetic);
+
+
+--
+-- Name: users_first_name_phonetic_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX users_first_name_phonetic_idx ON public.users USING btree (first_name_phonetic);
+
+
+--
+-- Name: users_second_name_phonetic_idx; Type: INDEX; Schema: public; Owner: postgres
+
+--
+
+CREATE INDEX users_second_name_phonetic_idx ON public.users USING btree (second_name_phonetic);
+
+
+--
+-- Name: user_nationalities user_nationalities_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_nationalities
+    ADD CONSTRAINT user_nationalities_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: user_field_provenance user_field_provenance_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_field_provenance
+    ADD CONSTRAINT user_field_provenance_pkey PRIMARY KEY (user_id, field);
+
+
+--
+-- Name: user_field_provenance user_field_provenance_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_field_provenance
+    ADD CONSTRAINT user_field_provenance_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: user_import_chunks user_import_chunks_import_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_import_chunks
+    ADD CONSTRAINT user_import_chunks_import_id_fkey FOREIGN KEY (import_id) REFERENCES public.user_imports(id) ON DELETE CASCADE;
+
+
+--
+-- Name: user_import_batches user_import_batches_import_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_import_batches
+    ADD CONSTRAINT user_import_batches_import_id_fkey FOREIGN KEY (import_id) REFERENCES public.user_imports(id) ON DELETE CASCADE;
+
+
+--
+-- Name: user_create_jobs user_create_jobs_job_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_create_jobs
+    ADD CONSTRAINT user_create_jobs_job_id_fkey FOREIGN KEY (job_id) REFERENCES public.jobs(id) ON DELETE CASCADE;
+
+
+--
+-- Name: user_create_jobs user_create_jobs_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+
+--
+
+ALTER TABLE ONLY public.user_create_jobs
+    ADD CONSTRAINT user_create_jobs_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
 --
 -- PostgreSQL database dump complete
 --